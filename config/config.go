@@ -38,10 +38,13 @@ var Settings *Config
 // Config represents the possible configurable parameters
 // for the local daemon
 type Config struct {
-	Get      Get
-	CORS     CORS
-	Database Database
-	Redis    Redis
+	Get            Get
+	CORS           CORS
+	Database       Database
+	Redis          Redis
+	CircuitBreaker CircuitBreaker
+	Internal       Internal
+	Analytics      Analytics
 }
 
 // Get sets what the daemon listens on
@@ -52,6 +55,14 @@ type Get struct {
 	DatabaseMaxConnections int
 	RedisMaxIdle           int
 	RedisMaxConnections    int
+	MemoryCacheMaxSize     int64
+	MemoryCacheMaxItemSize int64
+	WarmupPages            uint
+	CacheFillLease         bool
+	CacheEarlyRefreshBeta  float64
+	CacheDiagnostics       bool
+	CacheNamespace         string
+	CacheStore             string
 	DataDog                bool
 }
 
@@ -74,3 +85,49 @@ type Redis struct {
 type CORS struct {
 	Sites []string
 }
+
+// CircuitBreaker holds the thresholds of the cache circuit breaker, zero values
+// keep the defaults. A FailureRate switches it from consecutive failures to the
+// failure rate over a sliding window.
+type CircuitBreaker struct {
+	FailureThreshold    uint32
+	ResetTimeout        uint // seconds
+	HalfOpenMaxRequests uint32
+	FailureRate         float64
+	Window              uint // seconds
+	MinimumRequests     uint32
+	SlowCallThreshold   uint // milliseconds
+}
+
+// Internal sets what the internal endpoints listen on, they are off without a port
+// and only on 127.0.0.1 without a host
+type Internal struct {
+	Host string
+	Port uint
+}
+
+// Analytics sets how analytics records are written. Sinks lists where they go,
+// any of mysql, file and redis, and defaults to mysql. IPMode is raw, truncate
+// or hash, and rows older than RetentionDays are removed by the retention command.
+// Bots are flagged by user agent, by request rate and by the networks in BotIPFile.
+// Views counts thread and image views and visitors in Redis, and Stats rolls
+// requests up into Redis counters for the moderator reports.
+type Analytics struct {
+	QueueSize          int
+	BatchSize          int
+	Sinks              []string
+	File               string
+	FileMaxSize        int64 // bytes
+	Stream             string
+	StreamMaxLen       int64
+	IPMode             string
+	RetentionDays      uint
+	RetentionAggregate bool
+	RetentionBatchSize int
+	BotUserAgents      []string
+	BotRateLimit       int // requests per minute
+	BotIPFile          string
+	ExcludeBots        bool
+	Views              bool
+	Stats              bool
+}
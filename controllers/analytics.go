@@ -0,0 +1,16 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	m "github.com/eirka/eirka-get/middleware"
+)
+
+// AnalyticsWriterController shows the analytics queue and writer counters
+func AnalyticsWriterController(c *gin.Context) {
+
+	c.JSON(http.StatusOK, m.AnalyticsQueue.Stats())
+
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	e "github.com/eirka/eirka-libs/errors"
+
+	m "github.com/eirka/eirka-get/middleware"
+)
+
+// breakers are the circuit breakers operators can look at and control
+func breakers() map[string]*m.CacheCircuitBreaker {
+	return map[string]*m.CacheCircuitBreaker{
+		"cache":    m.CircuitBreaker,
+		"database": m.DatabaseCircuitBreaker,
+	}
+}
+
+// BreakersController shows the state and recent history of the circuit breakers
+func BreakersController(c *gin.Context) {
+
+	stats := make(map[string]m.CircuitBreakerStats)
+
+	for name, breaker := range breakers() {
+		stats[name] = breaker.Stats()
+	}
+
+	c.JSON(http.StatusOK, stats)
+
+}
+
+// BreakerController forces a circuit breaker open or closed, or hands it back
+// to the breaker with auto
+func BreakerController(c *gin.Context) {
+
+	breaker, ok := breakers()[c.Param("name")]
+	if !ok {
+		c.JSON(e.ErrorMessage(e.ErrNotFound))
+		c.Error(e.ErrNotFound).SetMeta("BreakerController.Name")
+		return
+	}
+
+	switch c.Param("state") {
+	case "open":
+		breaker.Force(m.StateOpen)
+	case "closed":
+		breaker.Force(m.StateClosed)
+	case "auto":
+		breaker.Release()
+	default:
+		c.JSON(e.ErrorMessage(e.ErrInvalidParam))
+		c.Error(e.ErrInvalidParam).SetMeta("BreakerController.State")
+		return
+	}
+
+	c.JSON(http.StatusOK, breaker.Stats())
+
+}
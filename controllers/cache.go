@@ -0,0 +1,22 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	m "github.com/eirka/eirka-get/middleware"
+)
+
+// MemoryCacheController shows the memory cache counters and how full it is
+func MemoryCacheController(c *gin.Context) {
+
+	hits, misses := m.InMemoryCache.Stats()
+
+	c.JSON(http.StatusOK, gin.H{
+		"hits":   hits,
+		"misses": misses,
+		"size":   m.InMemoryCache.Size(),
+	})
+
+}
@@ -46,14 +46,6 @@ func ImageController(c *gin.Context) {
 		return
 	}
 
-	// Check if this is a cacheMiss (request from cache middleware)
-	if _, ok := c.Get("cacheMiss"); ok {
-		// Get the data callback function and use it to send the data
-		if callback, ok := c.Get("setDataCallback"); ok {
-			callback.(func([]byte, error))(output, nil)
-		}
-	}
-
-	// Always write the response back to the client
+	// Write the response, the cache middleware records it on a cache miss
 	c.Data(http.StatusOK, "application/json", output)
 }
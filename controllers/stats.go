@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	e "github.com/eirka/eirka-libs/errors"
+
+	m "github.com/eirka/eirka-get/middleware"
+)
+
+// defaultStatsWindow is the window reported without a window query
+const defaultStatsWindow = "day"
+
+// BoardStatsController shows the traffic of a board with its top threads and tags
+func BoardStatsController(c *gin.Context) {
+	boardStats(c, func([]uint) string { return "board" })
+}
+
+// ThreadStatsController shows the traffic of a thread
+func ThreadStatsController(c *gin.Context) {
+	boardStats(c, func(params []uint) string { return "thread:" + strconv.FormatUint(uint64(params[1]), 10) })
+}
+
+// TagStatsController shows the traffic of a tag
+func TagStatsController(c *gin.Context) {
+	boardStats(c, func(params []uint) string { return "tag:" + strconv.FormatUint(uint64(params[1]), 10) })
+}
+
+// boardStats writes the stats of the scope in the route over the window in the query
+func boardStats(c *gin.Context, scope func(params []uint) string) {
+
+	// Get parameters from validate middleware
+	params := c.MustGet("params").([]uint)
+
+	window := c.DefaultQuery("window", defaultStatsWindow)
+
+	if _, ok := m.StatsWindows[window]; !ok {
+		c.JSON(e.ErrorMessage(e.ErrInvalidParam))
+		c.Error(e.ErrInvalidParam).SetMeta("StatsController.Window")
+		return
+	}
+
+	stats, err := m.BoardStats(strconv.FormatUint(uint64(params[0]), 10), scope(params), window, time.Now())
+	if err != nil {
+		c.JSON(e.ErrorMessage(e.ErrInternalError))
+		c.Error(err).SetMeta("StatsController.BoardStats")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"stats": stats})
+
+}
@@ -0,0 +1,60 @@
+package controllers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	e "github.com/eirka/eirka-libs/errors"
+
+	m "github.com/eirka/eirka-get/middleware"
+)
+
+// defaultViewDays is how many days of views are counted without a days query
+const defaultViewDays = 7
+
+// ThreadViewsController shows the views and unique visitors of a thread
+func ThreadViewsController(c *gin.Context) {
+	itemViews(c, "thread")
+}
+
+// ImageViewsController shows the views and unique visitors of an image
+func ImageViewsController(c *gin.Context) {
+	itemViews(c, "image")
+}
+
+// itemViews writes the view counts of the item in the route
+func itemViews(c *gin.Context, item string) {
+
+	// Get parameters from validate middleware
+	params := c.MustGet("params").([]uint)
+
+	// the number of days to count, up to the days that are kept
+	days := defaultViewDays
+
+	if query := c.Query("days"); query != "" {
+		var err error
+
+		days, err = strconv.Atoi(query)
+		if err != nil || days < 1 || days > m.MaxViewDays {
+			c.JSON(e.ErrorMessage(e.ErrInvalidParam))
+			c.Error(e.ErrInvalidParam).SetMeta("ViewsController.Days")
+			return
+		}
+	}
+
+	ib := strconv.FormatUint(uint64(params[0]), 10)
+	id := strconv.FormatUint(uint64(params[1]), 10)
+
+	counts, err := m.ItemViews(ib, item, id, days, time.Now())
+	if err != nil {
+		c.JSON(e.ErrorMessage(e.ErrInternalError))
+		c.Error(err).SetMeta("ViewsController.ItemViews")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"views": counts})
+
+}
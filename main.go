@@ -1,8 +1,11 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"slices"
 	"strings"
 	"time"
 
@@ -23,17 +26,19 @@ import (
 	m "github.com/eirka/eirka-get/middleware"
 )
 
-func init() {
+// warmup runs the cache warmup and exits instead of starting the server
+var warmup = flag.Bool("warmup", false, "fill the cache for the first pages of every board and exit")
 
-	var err error
+// retention prunes old analytics rows and exits instead of starting the server
+var retention = flag.Bool("retention", false, "remove analytics rows older than the retention period and exit")
 
-	// create pid file
-	pidfile.SetPidfilePath("/run/eirka/eirka-get.pid")
+// defaultWarmupPages is how many pages the warmup command fills without a config value
+const defaultWarmupPages = 3
 
-	err = pidfile.Write()
-	if err != nil {
-		panic("Could not write pid file")
-	}
+// cacheConfig holds the cache middleware settings
+var cacheConfig = m.DefaultCacheConfig
+
+func init() {
 
 	if local.Settings != nil {
 		// Database connection settings
@@ -54,17 +59,97 @@ func init() {
 		// Get limits and stuff from database
 		config.GetDatabaseSettings()
 
-		// redis settings
-		r := redis.Redis{
-			// Redis address and max pool connections
-			Protocol:       local.Settings.Redis.Protocol,
-			Address:        local.Settings.Redis.Host,
-			MaxIdle:        local.Settings.Get.RedisMaxIdle,
-			MaxConnections: local.Settings.Get.RedisMaxConnections,
+		// redis is needed for the redis cache store, the analytics stream and the daily ip salts
+		useRedis := slices.Contains(local.Settings.Analytics.Sinks, "redis") || local.Settings.Analytics.Views || local.Settings.Analytics.Stats || local.Settings.Analytics.IPMode == "hash"
+
+		// where cache entries are kept, installs without redis can keep them in memory or not at all
+		switch local.Settings.Get.CacheStore {
+		case "", "redis":
+			useRedis = true
+		case "memory":
+			m.Store = m.NewMemoryStore(m.DefaultMemoryStoreSize)
+		case "none":
+			m.Store = m.NewNoopStore()
+		default:
+			panic("Unknown cache store " + local.Settings.Get.CacheStore)
+		}
+
+		if useRedis {
+			// redis settings
+			r := redis.Redis{
+				// Redis address and max pool connections
+				Protocol:       local.Settings.Redis.Protocol,
+				Address:        local.Settings.Redis.Host,
+				MaxIdle:        local.Settings.Get.RedisMaxIdle,
+				MaxConnections: local.Settings.Get.RedisMaxConnections,
+			}
+
+			// Set up Redis connection
+			r.NewRedisCache()
+		}
+
+		// in-process cache size, zero keeps the default and negative disables it
+		memory := m.DefaultMemoryCacheConfig
+
+		if local.Settings.Get.MemoryCacheMaxSize != 0 {
+			memory.MaxSize = local.Settings.Get.MemoryCacheMaxSize
+		}
+
+		if local.Settings.Get.MemoryCacheMaxItemSize != 0 {
+			memory.MaxItemSize = local.Settings.Get.MemoryCacheMaxItemSize
+		}
+
+		m.InMemoryCache = m.NewMemoryCacheWithConfig(memory)
+
+		// analytics writer queue and batch sizes, zero keeps the default
+		analytics := m.DefaultAnalyticsWriterConfig
+
+		if local.Settings.Analytics.QueueSize > 0 {
+			analytics.QueueSize = local.Settings.Analytics.QueueSize
+		}
+
+		if local.Settings.Analytics.BatchSize > 0 {
+			analytics.BatchSize = local.Settings.Analytics.BatchSize
+		}
+
+		analytics.Sink = analyticsSink(local.Settings.Analytics)
+
+		// count views next to whatever the records are written to
+		if local.Settings.Analytics.Views {
+			analytics.Sink = m.MultiSink{analytics.Sink, m.NewViewSink()}
+		}
+
+		// and roll requests up for the board reports
+		if local.Settings.Analytics.Stats {
+			analytics.Sink = m.MultiSink{analytics.Sink, m.NewStatsSink()}
 		}
 
-		// Set up Redis connection
-		r.NewRedisCache()
+		// how client addresses are kept in the analytics
+		m.AnalyticsIP = m.NewIPAnonymizerWithConfig(analyticsIPConfig(local.Settings.Analytics))
+
+		// how crawlers are told apart from people
+		m.Bots = m.NewBotDetectorWithConfig(botDetectorConfig(local.Settings.Analytics))
+
+		m.AnalyticsQueue = m.NewAnalyticsWriterWithConfig(analytics)
+
+		// cache circuit breaker thresholds
+		m.CircuitBreaker = m.NewCircuitBreakerWithConfig(circuitBreakerConfig(local.Settings.CircuitBreaker))
+
+		// early refresh of hot keys, zero keeps the default and negative disables it
+		if local.Settings.Get.CacheEarlyRefreshBeta != 0 {
+			cacheConfig.EarlyRefreshBeta = max(0, local.Settings.Get.CacheEarlyRefreshBeta)
+		}
+
+		// add the X-Cache headers for debugging
+		cacheConfig.Diagnostics = local.Settings.Get.CacheDiagnostics
+
+		// keep entries apart from other deployments using the same redis
+		cacheConfig.Namespace = local.Settings.Get.CacheNamespace
+
+		// share cache fills between instances, the lease lasts as long as a fill may run
+		if local.Settings.Get.CacheFillLease {
+			cacheConfig.LeaseTTL = cacheConfig.FillTimeout
+		}
 
 		// set cors domains
 		cors.SetDomains(local.Settings.CORS.Sites, strings.Split("GET", ","))
@@ -75,10 +160,48 @@ func init() {
 }
 
 func main() {
+	flag.Parse()
+
+	if *warmup {
+		pages := local.Settings.Get.WarmupPages
+		if pages == 0 {
+			pages = defaultWarmupPages
+		}
+
+		warmed, err := warmCache(warmupEngine(), pages)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Warmed %d pages\n", warmed)
+		return
+	}
+
+	if *retention {
+		removed, err := m.PruneAnalytics(analyticsRetentionConfig(local.Settings.Analytics))
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Removed %d analytics rows\n", removed)
+		return
+	}
+
+	// create pid file
+	pidfile.SetPidfilePath("/run/eirka/eirka-get.pid")
+
+	if err := pidfile.Write(); err != nil {
+		panic("Could not write pid file")
+	}
+
 	r := gin.Default()
 
 	// add CORS headers
 	r.Use(cors.CORS())
+	// add Cache-Control headers from the route policies
+	r.Use(m.CacheControl())
 	// validate all route parameters
 	r.Use(validate.ValidateParams())
 
@@ -89,8 +212,81 @@ func main() {
 	public := r.Group("/")
 	public.Use(user.Auth(false))
 	public.Use(m.Analytics())
-	public.Use(m.Cache())
+	public.Use(m.CacheWithConfig(cacheConfig))
+	// stop queries while mysql is failing, the cache serves what it has
+	public.Use(m.DatabaseBreaker())
+
+	publicRoutes(public)
+
+	// user pages
+	users := r.Group("/user")
+	users.Use(user.Auth(true))
+	users.Use(m.DatabaseBreaker())
+
+	users.GET("/favorite/:id", c.FavoriteController)
+	users.GET("/favorites/:ib/:page", c.FavoritesController)
+
+	// view counts come from redis and never touch the database
+	if local.Settings.Analytics.Views {
+		r.GET("/views/thread/:ib/:thread", c.ThreadViewsController)
+		r.GET("/views/image/:ib/:id", c.ImageViewsController)
+	}
+
+	// board reports for moderators, read from redis counters
+	if local.Settings.Analytics.Stats {
+		stats := r.Group("/stats")
+		stats.Use(user.Auth(true))
+		stats.Use(user.Protect())
+
+		stats.GET("/:ib", c.BoardStatsController)
+		stats.GET("/:ib/thread/:thread", c.ThreadStatsController)
+		stats.GET("/:ib/tag/:tag", c.TagStatsController)
+	}
+
+	// prefetch the busiest pages in the background so a cold cache after a
+	// flush or deploy does not send every early request to the database
+	if local.Settings.Get.WarmupPages > 0 {
+		go func() {
+			_, _ = warmCache(warmupEngine(), local.Settings.Get.WarmupPages)
+		}()
+	}
+
+	// remove cache fields left behind by older schema versions
+	go func() {
+		_, _ = m.CollectSchemas(cacheConfig)
+	}()
+
+	if local.Settings != nil {
+		servers := []*http.Server{{
+			Addr:              fmt.Sprintf("%s:%d", local.Settings.Get.Host, local.Settings.Get.Port),
+			ReadHeaderTimeout: 2 * time.Second,
+			Handler:           r,
+		}}
 
+		// the internal endpoints get their own listener so they are never public
+		if local.Settings.Internal.Port != 0 {
+			servers = append(servers, &http.Server{
+				Addr:              internalAddr(local.Settings.Internal),
+				ReadHeaderTimeout: 2 * time.Second,
+				Handler:           internalEngine(),
+			})
+		}
+
+		err := gracehttp.Serve(servers...)
+
+		// write the analytics still queued once the last request has finished
+		m.AnalyticsQueue.Close()
+
+		if err != nil {
+			panic("Could not start server")
+		}
+	} else {
+		panic("Could not initialize settings")
+	}
+}
+
+// publicRoutes registers the public pages on a group
+func publicRoutes(public *gin.RouterGroup) {
 	public.GET("/index/:ib/:page", c.IndexController)
 	public.GET("/thread/:ib/:thread/:page", c.ThreadController)
 	public.GET("/tag/:ib/:tag/:page", c.TagController)
@@ -107,26 +303,165 @@ func main() {
 	public.GET("/tagtypes", c.TagTypesController)
 	public.GET("/imageboards", c.ImageboardsController)
 	public.GET("/whoami/:ib", c.WhoAmIController)
+}
 
-	// user pages
-	users := r.Group("/user")
-	users.Use(user.Auth(true))
+// internalEngine returns the router for the operator endpoints
+func internalEngine() *gin.Engine {
+	r := gin.New()
 
-	users.GET("/favorite/:id", c.FavoriteController)
-	users.GET("/favorites/:ib/:page", c.FavoritesController)
+	r.Use(gin.Recovery())
 
-	if local.Settings != nil {
-		s := &http.Server{
-			Addr:              fmt.Sprintf("%s:%d", local.Settings.Get.Host, local.Settings.Get.Port),
-			ReadHeaderTimeout: 2 * time.Second,
-			Handler:           r,
+	r.GET("/breakers", c.BreakersController)
+	r.POST("/breakers/:name/:state", c.BreakerController)
+	r.GET("/analytics", c.AnalyticsWriterController)
+	r.GET("/cache", c.MemoryCacheController)
+
+	return r
+}
+
+// internalAddr returns the address of the internal listener. The endpoints have no
+// authentication and can force the breakers open, so without a host they are only
+// served on the loopback interface.
+func internalAddr(settings local.Internal) string {
+	host := settings.Host
+	if host == "" {
+		host = "127.0.0.1"
+	}
+
+	return fmt.Sprintf("%s:%d", host, settings.Port)
+}
+
+// circuitBreakerConfig returns the cache circuit breaker config from the settings
+func circuitBreakerConfig(settings local.CircuitBreaker) m.CircuitBreakerConfig {
+	breaker := m.DefaultCircuitBreakerConfig
+
+	if settings.FailureThreshold != 0 {
+		breaker.FailureThreshold = settings.FailureThreshold
+	}
+
+	if settings.ResetTimeout != 0 {
+		breaker.ResetTimeout = time.Duration(settings.ResetTimeout) * time.Second
+	}
+
+	if settings.HalfOpenMaxRequests != 0 {
+		breaker.HalfOpenMaxRequests = settings.HalfOpenMaxRequests
+	}
+
+	// open the circuit on the failure rate instead of consecutive failures
+	if settings.FailureRate > 0 {
+		breaker.Mode = m.ModeFailureRate
+		breaker.FailureRate = settings.FailureRate
+	}
+
+	if settings.Window != 0 {
+		breaker.Window = time.Duration(settings.Window) * time.Second
+	}
+
+	if settings.MinimumRequests != 0 {
+		breaker.MinimumRequests = settings.MinimumRequests
+	}
+
+	if settings.SlowCallThreshold != 0 {
+		breaker.SlowCallThreshold = time.Duration(settings.SlowCallThreshold) * time.Millisecond
+	}
+
+	return breaker
+}
+
+// analyticsSink returns the sinks analytics are written to from the settings
+func analyticsSink(settings local.Analytics) m.AnalyticsSink {
+	if len(settings.Sinks) == 0 {
+		return m.NewMySQLSink()
+	}
+
+	var sinks m.MultiSink
+
+	for _, name := range settings.Sinks {
+		switch name {
+		case "mysql":
+			sinks = append(sinks, m.NewMySQLSink())
+		case "file":
+			file, err := m.NewFileSink(settings.File, settings.FileMaxSize)
+			if err != nil {
+				panic("Could not open analytics file: " + err.Error())
+			}
+			sinks = append(sinks, file)
+		case "redis":
+			stream := settings.Stream
+			if stream == "" {
+				stream = "analytics"
+			}
+			sinks = append(sinks, m.NewRedisStreamSink(stream, settings.StreamMaxLen))
+		default:
+			panic("Unknown analytics sink " + name)
 		}
+	}
+
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+
+	return sinks
+}
+
+// analyticsIPConfig returns how client addresses are stored from the settings
+func analyticsIPConfig(settings local.Analytics) m.IPAnonymizerConfig {
+	config := m.DefaultIPAnonymizerConfig
+
+	switch settings.IPMode {
+	case "", "raw":
+		config.Mode = m.IPRaw
+	case "truncate":
+		config.Mode = m.IPTruncate
+	case "hash":
+		config.Mode = m.IPHash
+		// the daily salts are shared through redis
+		config.Shared = true
+	default:
+		panic("Unknown analytics IP mode " + settings.IPMode)
+	}
 
-		err := gracehttp.Serve(s)
+	return config
+}
+
+// analyticsRetentionConfig returns how old analytics rows are pruned from the settings
+func analyticsRetentionConfig(settings local.Analytics) m.AnalyticsRetentionConfig {
+	config := m.DefaultAnalyticsRetentionConfig
+
+	if settings.RetentionDays != 0 {
+		config.MaxAge = time.Duration(settings.RetentionDays) * 24 * time.Hour
+	}
+
+	if settings.RetentionBatchSize > 0 {
+		config.BatchSize = settings.RetentionBatchSize
+	}
+
+	config.Aggregate = settings.RetentionAggregate
+
+	return config
+}
+
+// botDetectorConfig returns the analytics bot detection from the settings
+func botDetectorConfig(settings local.Analytics) m.BotDetectorConfig {
+	config := m.DefaultBotDetectorConfig
+
+	// extra user agents are added to the defaults
+	config.UserAgents = append(slices.Clone(config.UserAgents), settings.BotUserAgents...)
+
+	// zero keeps the default rate and negative disables it
+	if settings.BotRateLimit != 0 {
+		config.RateLimit = settings.BotRateLimit
+	}
+
+	if settings.BotIPFile != "" {
+		prefixes, err := m.LoadCrawlerIPs(settings.BotIPFile)
 		if err != nil {
-			panic("Could not start server")
+			panic("Could not load crawler IPs: " + err.Error())
 		}
-	} else {
-		panic("Could not initialize settings")
+		config.CrawlerIPs = prefixes
 	}
+
+	config.Exclude = settings.ExcludeBots
+
+	return config
 }
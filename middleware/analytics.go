@@ -1,36 +1,63 @@
 package middleware
 
 import (
+	"encoding/json"
+	"net/http"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
-	"github.com/eirka/eirka-libs/db"
 	"github.com/eirka/eirka-libs/user"
+
+	u "github.com/eirka/eirka-get/utils"
 )
 
-// list of keys record
-var analyticsKey = map[string]bool{
-	"index":     true,
-	"thread":    true,
-	"tag":       true,
-	"image":     true,
-	"tags":      true,
-	"directory": true,
-	"popular":   true,
-}
-
-type requestType struct {
-	Ib        string
-	IP        string
-	User      uint
-	Path      string
-	ItemKey   string
-	ItemValue string
-	Status    int
-	Latency   time.Duration
-	Cached    bool
+// itemExtractor returns the item a request for a route is recorded under
+type itemExtractor func(c *gin.Context) string
+
+// analyticsItems maps the recorded routes to the item they record, single page
+// feeds are recorded as their first page
+var analyticsItems = map[string]itemExtractor{
+	"index":        itemParam("page"),
+	"thread":       itemParam("thread"),
+	"tag":          itemParam("tag"),
+	"image":        itemParam("id"),
+	"tags":         itemParam("page"),
+	"directory":    itemParam("page"),
+	"popular":      firstPage,
+	"new":          firstPage,
+	"favorited":    firstPage,
+	"post":         postItem,
+	"random":       randomItem,
+	"tagsearch":    searchItem,
+	"threadsearch": searchItem,
+}
+
+// searchTermMaxLength is how many characters of a search term are recorded
+const searchTermMaxLength = 64
+
+// emptyResultMaxSize is the largest response body checked for empty search results
+const emptyResultMaxSize = 64
+
+// AnalyticsRecord is a request recorded by the analytics middleware, Time is when
+// it started but the analytics table keeps the database clock at insert
+type AnalyticsRecord struct {
+	Ib        string        `json:"ib"`
+	IP        string        `json:"ip"`
+	User      uint          `json:"user"`
+	Path      string        `json:"path"`
+	ItemKey   string        `json:"item_key"`
+	ItemValue string        `json:"item_value"`
+	Status    int           `json:"status"`
+	Latency   time.Duration `json:"latency"`
+	Cached    bool          `json:"cached"`
+	Bot       bool          `json:"bot"`
+	Empty     bool          `json:"empty"`
+	Referrer  string        `json:"referrer"`
+	Browser   string        `json:"browser"`
+	Device    string        `json:"device"`
+	Time      time.Time     `json:"time"`
 }
 
 // Analytics will log requests in the database
@@ -40,15 +67,20 @@ func Analytics() gin.HandlerFunc {
 		// get userdata from session middleware
 		userdata := c.MustGet("userdata").(user.User)
 
-		// Make key from path
-		key := generateKey(req.URL.Path)
-
-		// skip if we're not recording this key
-		if !analyticsKey[strings.ToLower(key.Key)] {
+		// Make key from the route, skip if we're not recording it
+		key, ok := generateKey(c)
+		if !ok {
 			c.Next()
 			return
 		}
 
+		// searches keep the start of the response to tell if they found anything
+		var results *resultWriter
+		if isSearch(key.Key) {
+			results = &resultWriter{ResponseWriter: c.Writer}
+			c.Writer = results
+		}
+
 		// Start timer
 		start := time.Now()
 
@@ -67,10 +99,17 @@ func Analytics() gin.HandlerFunc {
 			return
 		}
 
+		// crawlers are flagged, or left out entirely if they are excluded
+		userAgent := req.UserAgent()
+		bot := Bots.IsBot(userAgent, c.ClientIP(), start)
+		if bot && Bots.Exclude() {
+			return
+		}
+
 		// set our data
-		request := requestType{
+		request := AnalyticsRecord{
 			Ib:        c.Param("ib"),
-			IP:        c.ClientIP(),
+			IP:        AnalyticsIP.Anonymize(c.ClientIP(), start),
 			User:      userdata.ID,
 			Path:      req.URL.Path,
 			Status:    c.Writer.Status(),
@@ -78,57 +117,131 @@ func Analytics() gin.HandlerFunc {
 			ItemKey:   key.Key,
 			ItemValue: key.Value,
 			Cached:    c.MustGet("cached").(bool),
+			Bot:       bot,
+			Empty:     results != nil && results.empty(),
+			Referrer:  referrerHost(req.Referer()),
+			Browser:   browserFamily(userAgent, bot),
+			Device:    deviceClass(userAgent, bot),
+			Time:      start,
 		}
 
-		// fire and forget
-		go insertRecord(request)
+		// the writer batches records into the database in the background
+		AnalyticsQueue.Enqueue(request)
 
 	}
 }
 
-func insertRecord(request requestType) (err error) {
+type itemKey struct {
+	Key   string
+	Value string
+}
+
+// generateKey returns the item a request is recorded under, or false if its
+// route is not recorded
+func generateKey(c *gin.Context) (itemKey, bool) {
+
+	// the route is the first part of the path
+	route, _, _ := strings.Cut(strings.Trim(c.Request.URL.Path, "/"), "/")
+	route = strings.ToLower(route)
 
-	// Get Database handle
-	dbase, err := db.GetDb()
-	if err != nil {
-		return
+	item, ok := analyticsItems[route]
+	if !ok {
+		return itemKey{}, false
 	}
 
-	// input data
-	_, err = dbase.Exec(`INSERT INTO analytics (ib_id, user_id, request_ip, request_path, request_status, request_latency, request_itemkey, request_itemvalue, request_cached, request_time) VALUES (?,?,?,?,?,?,?,?,?,NOW())`,
-		request.Ib, request.User, request.IP, request.Path, request.Status, request.Latency, request.ItemKey, request.ItemValue, request.Cached)
-	if err != nil {
-		return
+	return itemKey{Key: route, Value: item(c)}, true
+
+}
+
+// itemParam records the value of a route parameter
+func itemParam(name string) itemExtractor {
+	return func(c *gin.Context) string {
+		return c.Param(name)
 	}
+}
 
-	return
+// firstPage records routes without pages as their first page
+func firstPage(c *gin.Context) string {
+	return "1"
+}
 
+// postItem records a post as its thread and post number, post numbers are only
+// unique within a thread
+func postItem(c *gin.Context) string {
+	return c.Param("thread") + ":" + c.Param("id")
 }
 
-type itemKey struct {
-	Key   string
-	Value string
+// randomItem records what kind of item was picked
+func randomItem(c *gin.Context) string {
+	parts := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// searchItem records the normalized search term
+func searchItem(c *gin.Context) string {
+	return normalizeSearch(c.Query("search"))
 }
 
-// Will take the params from the request and turn them into a key
-func generateKey(path string) itemKey {
+// isSearch returns true if the route is a search
+func isSearch(route string) bool {
+	return route == "tagsearch" || route == "threadsearch"
+}
 
-	// Trim leading / from path and split
-	params := strings.Split(strings.Trim(path, "/"), "/")
-	// new item key
-	r := itemKey{}
+// normalizeSearch lowercases a search term, strips the characters the search
+// ignores, collapses whitespace and cuts it to a length the table can hold
+func normalizeSearch(term string) string {
+	normalized := strings.Join(strings.Fields(strings.ToLower(u.FormatQuery(term))), " ")
 
-	if params != nil {
-		switch {
-		case len(params) <= 2:
-			r.Key = params[0]
-			r.Value = "1"
-		case len(params) >= 3:
-			r.Key = params[0]
-			r.Value = params[2]
-		}
+	if runes := []rune(normalized); len(runes) > searchTermMaxLength {
+		normalized = strings.TrimSpace(string(runes[:searchTermMaxLength]))
+	}
+
+	return normalized
+}
+
+// resultWriter keeps the start of a response body so a search that found nothing
+// can be told apart from one that did
+type resultWriter struct {
+	gin.ResponseWriter
+	body []byte
+}
+
+// Write keeps the first bytes of the body and passes it on
+func (w *resultWriter) Write(data []byte) (int, error) {
+	if room := emptyResultMaxSize - len(w.body); room > 0 {
+		w.body = append(w.body, data[:min(room, len(data))]...)
 	}
 
-	return r
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString keeps the first bytes of the body and passes it on
+func (w *resultWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+// empty returns true if the response is a JSON object holding only empty lists.
+// Empty results are far too small to be compressed, larger bodies are results.
+func (w *resultWriter) empty() bool {
+	if w.Status() != http.StatusOK || w.Header().Get("Content-Encoding") != "" || w.Size() > len(w.body) {
+		return false
+	}
+
+	var result map[string]json.RawMessage
+
+	if err := json.Unmarshal(w.body, &result); err != nil || len(result) == 0 {
+		return false
+	}
+
+	for _, value := range result {
+		if v := string(value); v != "[]" && v != "null" {
+			return false
+		}
+	}
 
+	return true
 }
@@ -0,0 +1,91 @@
+package middleware
+
+import (
+	"net/url"
+	"strings"
+)
+
+// referrerMaxLength is the longest referrer host that is recorded
+const referrerMaxLength = 255
+
+// browserFamilies match user agents to a browser family in order, browsers that
+// copy the tokens of others have to come before them
+var browserFamilies = []struct {
+	token  string
+	family string
+}{
+	{"edg/", "edge"},
+	{"edge/", "edge"},
+	{"opr/", "opera"},
+	{"opera", "opera"},
+	{"samsungbrowser/", "samsung"},
+	{"yabrowser/", "yandex"},
+	{"vivaldi/", "vivaldi"},
+	{"firefox/", "firefox"},
+	{"fxios/", "firefox"},
+	{"crios/", "chrome"},
+	{"chrome/", "chrome"},
+	{"chromium/", "chrome"},
+	{"msie ", "ie"},
+	{"trident/", "ie"},
+	{"safari/", "safari"},
+}
+
+// referrerHost returns the host of a referrer without the www prefix or port,
+// or an empty string if there is none. The path and query are never kept.
+func referrerHost(referrer string) string {
+	if referrer == "" {
+		return ""
+	}
+
+	parsed, err := url.Parse(referrer)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return ""
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	host = strings.TrimPrefix(host, "www.")
+
+	if len(host) > referrerMaxLength {
+		return ""
+	}
+
+	return host
+}
+
+// browserFamily returns the browser family of a user agent, bot for bots and
+// other for browsers it does not know
+func browserFamily(userAgent string, bot bool) string {
+	if bot {
+		return "bot"
+	}
+
+	agent := strings.ToLower(userAgent)
+
+	for _, browser := range browserFamilies {
+		if strings.Contains(agent, browser.token) {
+			return browser.family
+		}
+	}
+
+	return "other"
+}
+
+// deviceClass returns whether a user agent is a bot, tablet, mobile or desktop
+func deviceClass(userAgent string, bot bool) string {
+	if bot {
+		return "bot"
+	}
+
+	agent := strings.ToLower(userAgent)
+
+	switch {
+	case strings.Contains(agent, "ipad"), strings.Contains(agent, "tablet"),
+		strings.Contains(agent, "android") && !strings.Contains(agent, "mobile"):
+		return "tablet"
+	case strings.Contains(agent, "mobi"), strings.Contains(agent, "iphone"), strings.Contains(agent, "android"):
+		return "mobile"
+	}
+
+	return "desktop"
+}
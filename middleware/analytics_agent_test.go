@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReferrerHost(t *testing.T) {
+	assert.Equal(t, "google.com", referrerHost("https://www.google.com/search?q=secret"), "Host should match")
+	assert.Equal(t, "boards.example.org", referrerHost("http://Boards.Example.org:8080/thread/1"), "Host should match")
+	assert.Empty(t, referrerHost(""), "Missing referrers should be empty")
+	assert.Empty(t, referrerHost("android-app://com.example"), "Other schemes should be empty")
+	assert.Empty(t, referrerHost("not a url"), "Bad referrers should be empty")
+}
+
+func TestBrowserFamily(t *testing.T) {
+	tests := []struct {
+		agent   string
+		browser string
+		device  string
+	}{
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36", "chrome", "desktop"},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36 Edg/129.0.0.0", "edge", "desktop"},
+		{"Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0", "firefox", "desktop"},
+		{"Mozilla/5.0 (iPhone; CPU iPhone OS 18_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/18.0 Mobile/15E148 Safari/604.1", "safari", "mobile"},
+		{"Mozilla/5.0 (iPad; CPU OS 18_0 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) CriOS/129.0 Mobile/15E148 Safari/604.1", "chrome", "tablet"},
+		{"Mozilla/5.0 (Linux; Android 14; SM-S918B) AppleWebKit/537.36 (KHTML, like Gecko) SamsungBrowser/26.0 Chrome/122.0.0.0 Mobile Safari/537.36", "samsung", "mobile"},
+		{"Mozilla/5.0 (Linux; Android 14; SM-X710) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/129.0.0.0 Safari/537.36", "chrome", "tablet"},
+		{"Lynx/2.9.0", "other", "desktop"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.browser, browserFamily(test.agent, false), "Browser should match for %s", test.agent)
+		assert.Equal(t, test.device, deviceClass(test.agent, false), "Device should match for %s", test.agent)
+	}
+
+	assert.Equal(t, "bot", browserFamily("Googlebot/2.1", true), "Bots should be their own family")
+	assert.Equal(t, "bot", deviceClass("Googlebot/2.1", true), "Bots should be their own device")
+}
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"bufio"
+	"net/netip"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultBotUserAgents match the user agents of crawlers, scrapers and HTTP libraries
+var defaultBotUserAgents = []string{
+	`bot\b`, `crawl`, `spider`, `slurp`, `archiver`, `preview`, `fetch`,
+	`facebookexternalhit`, `headless`, `phantomjs`, `selenium`, `puppeteer`,
+	`^curl/`, `^wget/`, `python-requests`, `python-urllib`, `aiohttp`, `scrapy`,
+	`go-http-client`, `okhttp`, `java/`, `libwww-perl`, `httpclient`, `axios/`, `node-fetch`,
+}
+
+// BotDetectorConfig holds the configuration for the analytics bot detector
+type BotDetectorConfig struct {
+	// UserAgents are case insensitive patterns for bot user agents, requests
+	// without a user agent are always bots
+	UserAgents []string
+	// RateLimit is how many recorded requests an address may make in a Window
+	// before the rest are counted as a bot, zero turns the check off
+	RateLimit int
+	// Window is the length of the rate limit window
+	Window time.Duration
+	// CrawlerIPs are the networks of known crawlers
+	CrawlerIPs []netip.Prefix
+	// Exclude drops bot requests instead of recording them flagged
+	Exclude bool
+}
+
+// DefaultBotDetectorConfig provides sensible defaults for the bot detector
+var DefaultBotDetectorConfig = BotDetectorConfig{
+	UserAgents: defaultBotUserAgents,
+	RateLimit:  120,
+	Window:     time.Minute,
+}
+
+// Bots is the bot detector the analytics middleware classifies requests with
+var Bots = NewBotDetector()
+
+// BotDetector tells crawler and scraper requests apart from people so they do
+// not inflate the hit counts the popular page ranks on
+type BotDetector struct {
+	config     BotDetectorConfig
+	userAgents *regexp.Regexp
+
+	// mutex guards the request counts of the current window
+	mutex  sync.Mutex
+	start  time.Time
+	counts map[string]int
+}
+
+// NewBotDetector creates a new bot detector with default configuration
+func NewBotDetector() *BotDetector {
+	return NewBotDetectorWithConfig(DefaultBotDetectorConfig)
+}
+
+// NewBotDetectorWithConfig creates a new bot detector with the given configuration,
+// it panics if a user agent pattern does not compile
+func NewBotDetectorWithConfig(config BotDetectorConfig) *BotDetector {
+	d := &BotDetector{
+		config: config,
+		counts: make(map[string]int),
+	}
+
+	if len(config.UserAgents) > 0 {
+		d.userAgents = regexp.MustCompile(`(?i)(` + strings.Join(config.UserAgents, `|`) + `)`)
+	}
+
+	return d
+}
+
+// Exclude returns true if bot requests should not be recorded
+func (d *BotDetector) Exclude() bool {
+	return d.config.Exclude
+}
+
+// IsBot returns true if a request from the user agent and address at the given
+// time looks like a bot, every call counts toward the rate of the address
+func (d *BotDetector) IsBot(userAgent, ip string, now time.Time) bool {
+	// counted first so a crawler with a browser user agent still builds up a rate
+	overLimit := d.count(ip, now)
+
+	if strings.TrimSpace(userAgent) == "" {
+		return true
+	}
+
+	if d.userAgents != nil && d.userAgents.MatchString(userAgent) {
+		return true
+	}
+
+	if d.crawler(ip) {
+		return true
+	}
+
+	return overLimit
+}
+
+// count adds a request from the address to the current window and returns true
+// if the address is over the limit. The window starts over as a whole so only the
+// addresses seen in the last window are held.
+func (d *BotDetector) count(ip string, now time.Time) bool {
+	if d.config.RateLimit <= 0 {
+		return false
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if now.Sub(d.start) >= d.config.Window {
+		d.start = now
+		clear(d.counts)
+	}
+
+	d.counts[ip]++
+
+	return d.counts[ip] > d.config.RateLimit
+}
+
+// crawler returns true if the address is in a known crawler network
+func (d *BotDetector) crawler(ip string) bool {
+	if len(d.config.CrawlerIPs) == 0 {
+		return false
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+
+	addr = addr.Unmap()
+
+	for _, prefix := range d.config.CrawlerIPs {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// LoadCrawlerIPs reads a list of crawler networks from a file with one address or
+// CIDR range per line, blank lines and lines starting with # are skipped
+func LoadCrawlerIPs(path string) (prefixes []netip.Prefix, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var prefix netip.Prefix
+
+		if strings.Contains(line, "/") {
+			prefix, err = netip.ParsePrefix(line)
+		} else {
+			var addr netip.Addr
+			addr, err = netip.ParseAddr(line)
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	err = scanner.Err()
+
+	return
+}
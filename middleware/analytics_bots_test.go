@@ -0,0 +1,128 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/user"
+	"github.com/eirka/eirka-libs/validate"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const browserUserAgent = "Mozilla/5.0 (X11; Linux x86_64; rv:131.0) Gecko/20100101 Firefox/131.0"
+
+func TestBotDetector(t *testing.T) {
+	now := time.Now()
+
+	d := NewBotDetectorWithConfig(BotDetectorConfig{
+		UserAgents: defaultBotUserAgents,
+		RateLimit:  3,
+		Window:     time.Minute,
+		CrawlerIPs: []netip.Prefix{netip.MustParsePrefix("66.249.64.0/19")},
+	})
+
+	assert.False(t, d.IsBot(browserUserAgent, "10.0.0.1", now), "Browsers should not be bots")
+	assert.True(t, d.IsBot("Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)", "10.0.0.2", now), "Googlebot should be a bot")
+	assert.True(t, d.IsBot("curl/8.5.0", "10.0.0.3", now), "curl should be a bot")
+	assert.True(t, d.IsBot("", "10.0.0.4", now), "Missing user agents should be bots")
+	assert.True(t, d.IsBot(browserUserAgent, "66.249.66.1", now), "Crawler networks should be bots")
+	assert.True(t, d.IsBot(browserUserAgent, "::ffff:66.249.66.1", now), "Mapped crawler addresses should be bots")
+
+	// the address is over the limit on its fourth request in the window
+	assert.False(t, d.IsBot(browserUserAgent, "10.0.0.1", now), "Request should be under the limit")
+	assert.False(t, d.IsBot(browserUserAgent, "10.0.0.1", now), "Request should be under the limit")
+	assert.True(t, d.IsBot(browserUserAgent, "10.0.0.1", now), "Request should be over the limit")
+	assert.False(t, d.IsBot(browserUserAgent, "10.0.0.5", now), "Other addresses should not be limited")
+
+	// and starts over in the next window
+	assert.False(t, d.IsBot(browserUserAgent, "10.0.0.1", now.Add(time.Minute)), "Limit should start over")
+}
+
+func TestLoadCrawlerIPs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "crawlers.txt")
+
+	err := os.WriteFile(path, []byte("# googlebot\n66.249.64.0/19\n\n157.55.39.1\n2001:4860:4801:10::/64\n"), 0o600)
+	assert.NoError(t, err, "An error was not expected")
+
+	prefixes, err := LoadCrawlerIPs(path)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []netip.Prefix{
+		netip.MustParsePrefix("66.249.64.0/19"),
+		netip.MustParsePrefix("157.55.39.1/32"),
+		netip.MustParsePrefix("2001:4860:4801:10::/64"),
+	}, prefixes, "Networks should match")
+
+	err = os.WriteFile(path, []byte("not an address\n"), 0o600)
+	assert.NoError(t, err, "An error was not expected")
+
+	_, err = LoadCrawlerIPs(path)
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestAnalyticsBots(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	config.Settings.Session.NewSecret = "secret"
+
+	router := gin.New()
+
+	router.Use(validate.ValidateParams())
+	router.Use(user.Auth(false))
+	router.Use(Analytics())
+	router.Use(testCache())
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	request := func(userAgent string) {
+		req := httptest.NewRequest(http.MethodGet, "/index/1/1", nil)
+		req.Header.Set("X-Real-Ip", "123.0.0.1")
+		req.Header.Set("User-Agent", userAgent)
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	// hold the records in the queue
+	AnalyticsQueue = NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     10,
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+	})
+	defer func() { AnalyticsQueue = NewAnalyticsWriter() }()
+	defer func() { Bots = NewBotDetector() }()
+
+	// keep the worker off so the records can be read back
+	AnalyticsQueue.start.Do(func() {})
+
+	// flagged bots are still recorded
+	request("Googlebot/2.1")
+	request(browserUserAgent)
+
+	records := make([]AnalyticsRecord, 0, 2)
+	for range 2 {
+		records = append(records, <-AnalyticsQueue.queue)
+	}
+
+	assert.True(t, records[0].Bot, "Crawler should be flagged")
+	assert.False(t, records[1].Bot, "Browser should not be flagged")
+	assert.Equal(t, "bot", records[0].Browser, "Browser should match")
+	assert.Equal(t, "firefox", records[1].Browser, "Browser should match")
+	assert.Equal(t, "desktop", records[1].Device, "Device should match")
+
+	// excluded bots are not
+	exclude := DefaultBotDetectorConfig
+	exclude.Exclude = true
+	Bots = NewBotDetectorWithConfig(exclude)
+
+	request("Googlebot/2.1")
+	request(browserUserAgent)
+
+	assert.Equal(t, uint64(3), AnalyticsQueue.Stats().Queued, "Only the browser should be queued")
+}
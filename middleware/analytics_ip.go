@@ -0,0 +1,156 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/netip"
+	"sync"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// IPMode is how client addresses are stored in analytics records
+type IPMode int
+
+const (
+	// IPRaw stores the address as is
+	IPRaw IPMode = iota
+	// IPTruncate stores the /24 of IPv4 and the /48 of IPv6 addresses
+	IPTruncate
+	// IPHash stores a hash of the address with a random salt that changes every day
+	IPHash
+)
+
+// ipHashLength is how many hex characters of the hash are kept
+const ipHashLength = 32
+
+// IPAnonymizerConfig holds the configuration for the analytics IP handling
+type IPAnonymizerConfig struct {
+	// Mode is how addresses are stored
+	Mode IPMode
+	// Shared keeps the daily salts in Redis so every instance hashes with the
+	// same salt, without it each instance has salts of its own
+	Shared bool
+	// SaltTTL is how long Redis keeps a salt, long enough for the instances to
+	// pick it up during its day and short enough that it is gone soon after
+	SaltTTL time.Duration
+}
+
+// DefaultIPAnonymizerConfig stores addresses as is
+var DefaultIPAnonymizerConfig = IPAnonymizerConfig{
+	Mode:    IPRaw,
+	SaltTTL: 48 * time.Hour,
+}
+
+// AnalyticsIP is how the analytics middleware stores client addresses
+var AnalyticsIP = NewIPAnonymizer()
+
+// IPAnonymizer turns client addresses into what is kept in analytics records
+type IPAnonymizer struct {
+	config IPAnonymizerConfig
+
+	// mutex guards the salt of the current day
+	mutex sync.Mutex
+	day   string
+	salt  []byte
+}
+
+// NewIPAnonymizer creates a new IP anonymizer with default configuration
+func NewIPAnonymizer() *IPAnonymizer {
+	return NewIPAnonymizerWithConfig(DefaultIPAnonymizerConfig)
+}
+
+// NewIPAnonymizerWithConfig creates a new IP anonymizer with the given configuration
+func NewIPAnonymizerWithConfig(config IPAnonymizerConfig) *IPAnonymizer {
+	return &IPAnonymizer{
+		config: config,
+	}
+}
+
+// Anonymize returns the address to store for a request at the given time,
+// addresses that do not parse are dropped unless they are stored as is
+func (a *IPAnonymizer) Anonymize(ip string, now time.Time) string {
+	if a.config.Mode == IPRaw {
+		return ip
+	}
+
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+
+	addr = addr.Unmap().WithZone("")
+
+	if a.config.Mode == IPTruncate {
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return ""
+		}
+
+		return prefix.Addr().String()
+	}
+
+	mac := hmac.New(sha256.New, a.daySalt(now))
+	mac.Write(addr.AsSlice())
+
+	return hex.EncodeToString(mac.Sum(nil))[:ipHashLength]
+}
+
+// daySalt returns the salt for the UTC day of the time. Hashes from different
+// days do not match so visitors can not be followed across days.
+func (a *IPAnonymizer) daySalt(now time.Time) []byte {
+	day := now.UTC().Format(time.DateOnly)
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if day != a.day {
+		a.day = day
+		a.salt = a.newSalt(day)
+	}
+
+	return a.salt
+}
+
+// newSalt returns a random salt for a day. Salts are not derived from anything,
+// so once the day is over and Redis has expired it the hashes of that day can not
+// be linked back to addresses. If Redis fails the instance uses a salt of its own
+// for the day, which only costs matching hashes across instances.
+func (a *IPAnonymizer) newSalt(day string) []byte {
+	salt := make([]byte, sha256.Size)
+	rand.Read(salt)
+
+	if !a.config.Shared {
+		return salt
+	}
+
+	shared, err := sharedSalt("ipsalt:"+day, salt, a.config.SaltTTL)
+	if err != nil {
+		return salt
+	}
+
+	return shared
+}
+
+// sharedSalt stores the salt for a day unless another instance got there first,
+// and returns the salt every instance uses
+func sharedSalt(key string, salt []byte, ttl time.Duration) ([]byte, error) {
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	if _, err := conn.Do("SET", key, salt, "NX", "PX", ttl.Milliseconds()); err != nil {
+		return nil, err
+	}
+
+	return redigo.Bytes(conn.Do("GET", key))
+}
@@ -0,0 +1,73 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	raw := NewIPAnonymizer()
+	assert.Equal(t, "10.1.2.3", raw.Anonymize("10.1.2.3", now), "Raw addresses should not change")
+
+	truncate := NewIPAnonymizerWithConfig(IPAnonymizerConfig{Mode: IPTruncate})
+	assert.Equal(t, "10.1.2.0", truncate.Anonymize("10.1.2.3", now), "IPv4 should be cut to the /24")
+	assert.Equal(t, "10.1.2.0", truncate.Anonymize("::ffff:10.1.2.3", now), "Mapped IPv4 should be cut to the /24")
+	assert.Equal(t, "2001:db8:1::", truncate.Anonymize("2001:db8:1:2:3:4:5:6", now), "IPv6 should be cut to the /48")
+	assert.Empty(t, truncate.Anonymize("unknown", now), "Bad addresses should be dropped")
+
+	hash := NewIPAnonymizerWithConfig(IPAnonymizerConfig{Mode: IPHash})
+
+	first := hash.Anonymize("10.1.2.3", now)
+	assert.Len(t, first, ipHashLength, "Hash length should match")
+	assert.NotContains(t, first, "10.1.2", "Address should not be in the hash")
+	assert.Equal(t, first, hash.Anonymize("10.1.2.3", now.Add(time.Hour)), "Hash should be stable within a day")
+	assert.NotEqual(t, first, hash.Anonymize("10.1.2.4", now), "Addresses should not share a hash")
+	assert.NotEqual(t, first, hash.Anonymize("10.1.2.3", now.AddDate(0, 0, 1)), "Salt should change every day")
+
+	// a day's salt is random, so going back to it does not bring the old hashes back
+	assert.NotEqual(t, first, hash.Anonymize("10.1.2.3", now), "Old salts should not be recomputed")
+
+	// instances without a shared salt do not agree
+	other := NewIPAnonymizerWithConfig(IPAnonymizerConfig{Mode: IPHash})
+	assert.NotEqual(t, first, other.Anonymize("10.1.2.3", now), "Hash should not match without a shared salt")
+}
+
+func TestAnonymizeIPShared(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	redis.NewRedisMock()
+
+	salt := []byte("the salt another instance stored")
+
+	// the salt is only stored if no instance has one for the day yet
+	var keys []any
+	set := redis.Cache.Mock.GenericCommand("SET").Handle(func(args []any) (any, error) {
+		keys = append(keys, args[0])
+		assert.Equal(t, []any{"NX", "PX", int64(48 * time.Hour / time.Millisecond)}, args[2:], "Salt should expire")
+		return nil, nil
+	})
+	redis.Cache.Mock.Command("GET", "ipsalt:2026-10-17").Expect(salt)
+
+	config := DefaultIPAnonymizerConfig
+	config.Mode = IPHash
+	config.Shared = true
+
+	first := NewIPAnonymizerWithConfig(config)
+	second := NewIPAnonymizerWithConfig(config)
+
+	hash := first.Anonymize("10.1.2.3", now)
+	assert.Equal(t, hash, second.Anonymize("10.1.2.3", now), "Instances should agree on the hash")
+	assert.Equal(t, 2, redis.Cache.Mock.Stats(set), "Each instance should offer a salt")
+	assert.Equal(t, []any{"ipsalt:2026-10-17", "ipsalt:2026-10-17"}, keys, "Keys should match")
+
+	// without Redis the instance falls back to a salt of its own
+	redis.Cache.Mock.Command("GET", "ipsalt:2026-10-18").ExpectError(errors.New("redis is gone"))
+
+	assert.Len(t, first.Anonymize("10.1.2.3", now.AddDate(0, 0, 1)), ipHashLength, "Hash length should match")
+}
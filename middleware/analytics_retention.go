@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/eirka/eirka-libs/db"
+)
+
+// AnalyticsRetentionConfig holds the configuration for pruning old analytics rows
+type AnalyticsRetentionConfig struct {
+	// MaxAge is how long rows are kept
+	MaxAge time.Duration
+	// Aggregate rolls rows up into daily counts in analytics_daily before they
+	// are deleted
+	Aggregate bool
+	// BatchSize is about how many rows one statement removes, so the table is
+	// never locked for long
+	BatchSize int
+	// Pause is how long to wait between batches to let replication catch up
+	Pause time.Duration
+}
+
+// DefaultAnalyticsRetentionConfig provides sensible defaults for pruning analytics
+var DefaultAnalyticsRetentionConfig = AnalyticsRetentionConfig{
+	MaxAge:    90 * 24 * time.Hour,
+	BatchSize: 5000,
+	Pause:     100 * time.Millisecond,
+}
+
+// PruneAnalytics removes analytics rows older than the max age in batches and
+// returns how many were removed
+func PruneAnalytics(config AnalyticsRetentionConfig) (removed int64, err error) {
+	if config.MaxAge <= 0 || config.BatchSize <= 0 {
+		return 0, errors.New("analytics retention needs a max age and a batch size")
+	}
+
+	// Get Database handle
+	dbase, err := db.GetDb()
+	if err != nil {
+		return
+	}
+
+	// request_time is written with the database clock so the cutoff comes from it too
+	var cutoff time.Time
+
+	err = dbase.QueryRow(`SELECT NOW() - INTERVAL ? SECOND`, int64(config.MaxAge/time.Second)).Scan(&cutoff)
+	if err != nil {
+		return
+	}
+
+	for {
+		var n int64
+
+		if config.Aggregate {
+			n, err = aggregateBatch(dbase, cutoff, config.BatchSize)
+		} else {
+			n, err = deleteBatch(dbase, cutoff, config.BatchSize)
+		}
+
+		removed += n
+
+		if err != nil || n < int64(config.BatchSize) {
+			return
+		}
+
+		time.Sleep(config.Pause)
+	}
+}
+
+// deleteBatch deletes the oldest rows before the cutoff
+func deleteBatch(dbase *sql.DB, cutoff time.Time, size int) (int64, error) {
+	result, err := dbase.Exec(`DELETE FROM analytics WHERE request_time < ? ORDER BY request_time LIMIT ?`, cutoff, size)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// aggregateBatch adds the oldest rows before the cutoff to the daily counts and
+// deletes them in one transaction, so an interrupted run never counts a row twice.
+// A batch ends on a request time, rows sharing the last time go into the same batch.
+func aggregateBatch(dbase *sql.DB, cutoff time.Time, size int) (n int64, err error) {
+	end := cutoff
+
+	var last time.Time
+
+	err = dbase.QueryRow(`SELECT request_time FROM analytics WHERE request_time < ? ORDER BY request_time LIMIT 1 OFFSET ?`, cutoff, size-1).Scan(&last)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		// the rest fits in one batch
+	case err != nil:
+		return
+	case last.Add(time.Microsecond).Before(cutoff):
+		// everything up to and including the last time
+		end = last.Add(time.Microsecond)
+	}
+
+	tx, err := dbase.Begin()
+	if err != nil {
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO analytics_daily (ib_id, request_day, request_itemkey, request_itemvalue, request_hits, request_bots, request_cached, request_latency)
+		SELECT ib_id, DATE(request_time), request_itemkey, request_itemvalue, COUNT(*), SUM(request_bot), SUM(request_cached), SUM(request_latency)
+		FROM analytics
+		WHERE request_time < ?
+		GROUP BY ib_id, DATE(request_time), request_itemkey, request_itemvalue
+		ON DUPLICATE KEY UPDATE
+		request_hits = request_hits + VALUES(request_hits),
+		request_bots = request_bots + VALUES(request_bots),
+		request_cached = request_cached + VALUES(request_cached),
+		request_latency = request_latency + VALUES(request_latency)`, end)
+	if err != nil {
+		return
+	}
+
+	result, err := tx.Exec(`DELETE FROM analytics WHERE request_time < ?`, end)
+	if err != nil {
+		return
+	}
+
+	n, err = result.RowsAffected()
+	if err != nil {
+		return
+	}
+
+	err = tx.Commit()
+
+	return
+}
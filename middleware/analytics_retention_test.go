@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/eirka/eirka-libs/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPruneAnalytics(t *testing.T) {
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	cutoff := time.Now().AddDate(0, 0, -1)
+
+	mock.ExpectQuery(`SELECT NOW\(\) - INTERVAL \? SECOND`).
+		WithArgs(86400).
+		WillReturnRows(sqlmock.NewRows([]string{"cutoff"}).AddRow(cutoff))
+
+	// batches run until one comes back short
+	mock.ExpectExec(`DELETE FROM analytics WHERE request_time < \? ORDER BY request_time LIMIT \?`).
+		WithArgs(cutoff, 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM analytics WHERE request_time < \? ORDER BY request_time LIMIT \?`).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	removed, err := PruneAnalytics(AnalyticsRetentionConfig{
+		MaxAge:    24 * time.Hour,
+		BatchSize: 2,
+	})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(3), removed, "Removed rows should match")
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
+
+	_, err = PruneAnalytics(AnalyticsRetentionConfig{BatchSize: 2})
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestPruneAnalyticsAggregate(t *testing.T) {
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	last := time.Now().AddDate(0, 0, -100)
+
+	mock.ExpectQuery(`SELECT NOW\(\) - INTERVAL \? SECOND`).
+		WithArgs(30 * 86400).
+		WillReturnRows(sqlmock.NewRows([]string{"cutoff"}).AddRow(time.Now().AddDate(0, 0, -30)))
+
+	// the first batch ends on the time of its last row
+	mock.ExpectQuery(`SELECT request_time FROM analytics WHERE request_time < \? ORDER BY request_time LIMIT 1 OFFSET \?`).
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnRows(sqlmock.NewRows([]string{"request_time"}).AddRow(last))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO analytics_daily .* FROM analytics WHERE request_time < \? GROUP BY .* ON DUPLICATE KEY UPDATE`).
+		WithArgs(last.Add(time.Microsecond)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM analytics WHERE request_time < \?`).
+		WithArgs(last.Add(time.Microsecond)).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectCommit()
+
+	// the rest fits in the second
+	mock.ExpectQuery(`SELECT request_time FROM analytics`).
+		WillReturnRows(sqlmock.NewRows([]string{"request_time"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO analytics_daily`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM analytics WHERE request_time < \?`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	removed, err := PruneAnalytics(AnalyticsRetentionConfig{
+		MaxAge:    30 * 24 * time.Hour,
+		Aggregate: true,
+		BatchSize: 2,
+	})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, int64(4), removed, "Removed rows should match")
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
+}
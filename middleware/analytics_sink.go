@@ -0,0 +1,292 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eirka/eirka-libs/db"
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// AnalyticsSink is where the analytics writer sends its batches
+type AnalyticsSink interface {
+	// Write stores a batch of records
+	Write(records []AnalyticsRecord) error
+	// Close flushes anything buffered, nothing is written after it
+	Close() error
+}
+
+// MySQLSink writes records to the analytics table
+type MySQLSink struct{}
+
+// NewMySQLSink returns a sink for the analytics table
+func NewMySQLSink() *MySQLSink {
+	return &MySQLSink{}
+}
+
+// Write inserts the records with a single multi-row INSERT, unless the database
+// circuit breaker is open
+func (s *MySQLSink) Write(records []AnalyticsRecord) error {
+	if databaseDown() {
+		return errDatabaseOpen
+	}
+
+	return insertRecords(records)
+}
+
+// Close does nothing, the database handle is shared
+func (s *MySQLSink) Close() error {
+	return nil
+}
+
+// insertRecords writes the records with a single multi-row INSERT. The request
+// time is the database clock at insert like it has always been, so rows line up
+// with older ones and with the NOW() windows in the models whatever time zone the
+// server runs in. Records are at most a flush interval old by then.
+func insertRecords(records []AnalyticsRecord) (err error) {
+
+	// Get Database handle
+	dbase, err := db.GetDb()
+	if err != nil {
+		return
+	}
+
+	rows := make([]string, len(records))
+	args := make([]any, 0, len(records)*14)
+
+	for i, request := range records {
+		rows[i] = "(?,?,?,?,?,?,?,?,?,?,?,?,?,?,NOW())"
+		args = append(args, request.Ib, request.User, request.IP, request.Path, request.Status, request.Latency, request.ItemKey, request.ItemValue, request.Cached, request.Bot, request.Empty, request.Referrer, request.Browser, request.Device)
+	}
+
+	// input data
+	_, err = dbase.Exec(`INSERT INTO analytics (ib_id, user_id, request_ip, request_path, request_status, request_latency, request_itemkey, request_itemvalue, request_cached, request_bot, request_empty, request_referrer, request_browser, request_device, request_time) VALUES `+strings.Join(rows, ","), args...)
+
+	return
+
+}
+
+// FileSink appends records to a file as newline delimited JSON. The file is
+// rotated when it would grow past MaxSize and when the day changes, rotated
+// files keep the time of the rotation in their name.
+type FileSink struct {
+	path    string
+	maxSize int64
+
+	mutex  sync.Mutex
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+	day    string
+}
+
+// NewFileSink opens a file sink, a zero maxSize only rotates daily
+func NewFileSink(path string, maxSize int64) (*FileSink, error) {
+	s := &FileSink{
+		path:    path,
+		maxSize: maxSize,
+	}
+
+	if err := s.open(time.Now()); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Write appends the records and flushes them to the file
+func (s *FileSink) Write(records []AnalyticsRecord) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return os.ErrClosed
+	}
+
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		line = append(line, '\n')
+
+		if err := s.rotate(time.Now(), int64(len(line))); err != nil {
+			return err
+		}
+
+		n, err := s.writer.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.writer.Flush()
+}
+
+// Close flushes and closes the file
+func (s *FileSink) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+
+	err := errors.Join(s.writer.Flush(), s.file.Close())
+	s.file = nil
+
+	return err
+}
+
+// rotate moves the current file aside if the next line would not fit in it or it
+// belongs to another day. The caller must hold the lock.
+func (s *FileSink) rotate(now time.Time, next int64) error {
+	full := s.maxSize > 0 && s.size > 0 && s.size+next > s.maxSize
+	if !full && now.Format(time.DateOnly) == s.day {
+		return nil
+	}
+
+	if err := errors.Join(s.writer.Flush(), s.file.Close()); err != nil {
+		return err
+	}
+
+	ext := filepath.Ext(s.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(s.path, ext), now.Format("20060102T150405.000000000"), ext)
+
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+
+	return s.open(now)
+}
+
+// open opens the file for appending. The caller must hold the lock.
+func (s *FileSink) open(now time.Time) error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.writer = bufio.NewWriter(file)
+	s.size = info.Size()
+	s.day = now.Format(time.DateOnly)
+
+	// A file left over from an earlier day keeps its day so it is rotated first
+	if info.Size() > 0 {
+		s.day = info.ModTime().Format(time.DateOnly)
+	}
+
+	return nil
+}
+
+// RedisStreamSink adds records to a Redis stream, trimmed to about MaxLen entries,
+// for consumers that move analytics off MySQL
+type RedisStreamSink struct {
+	stream string
+	maxLen int64
+}
+
+// NewRedisStreamSink returns a sink for a Redis stream, a zero maxLen keeps every entry
+func NewRedisStreamSink(stream string, maxLen int64) *RedisStreamSink {
+	return &RedisStreamSink{
+		stream: stream,
+		maxLen: maxLen,
+	}
+}
+
+// Write adds the records to the stream in a single pipeline
+func (s *RedisStreamSink) Write(records []AnalyticsRecord) error {
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	for _, record := range records {
+		args := []any{s.stream}
+
+		if s.maxLen > 0 {
+			args = append(args, "MAXLEN", "~", s.maxLen)
+		}
+
+		args = append(args, "*",
+			"ib", record.Ib,
+			"user", record.User,
+			"ip", record.IP,
+			"path", record.Path,
+			"status", record.Status,
+			"latency", int64(record.Latency),
+			"item_key", record.ItemKey,
+			"item_value", record.ItemValue,
+			"cached", strconv.FormatBool(record.Cached),
+			"bot", strconv.FormatBool(record.Bot),
+			"empty", strconv.FormatBool(record.Empty),
+			"referrer", record.Referrer,
+			"browser", record.Browser,
+			"device", record.Device,
+			"time", record.Time.Format(time.RFC3339Nano),
+		)
+
+		if err := conn.Send("XADD", args...); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for range records {
+		if _, err := conn.Receive(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close does nothing, the Redis pool is shared
+func (s *RedisStreamSink) Close() error {
+	return nil
+}
+
+// MultiSink writes every batch to several sinks
+type MultiSink []AnalyticsSink
+
+// Write writes the records to every sink, a failing sink does not stop the others
+func (s MultiSink) Write(records []AnalyticsRecord) error {
+	var errs []error
+
+	for _, sink := range s {
+		errs = append(errs, sink.Write(records))
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close closes every sink
+func (s MultiSink) Close() error {
+	var errs []error
+
+	for _, sink := range s {
+		errs = append(errs, sink.Close())
+	}
+
+	return errors.Join(errs...)
+}
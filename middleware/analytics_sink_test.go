@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+// errorSink fails every write
+type errorSink struct {
+	err    error
+	closed bool
+}
+
+func (s *errorSink) Write([]AnalyticsRecord) error { return s.err }
+
+func (s *errorSink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "analytics.json")
+
+	record := AnalyticsRecord{Ib: "1", IP: "10.0.0.1", Path: "/index/1/1", ItemKey: "index", ItemValue: "1", Status: 200, Time: time.Now()}
+
+	line, err := json.Marshal(record)
+	assert.NoError(t, err, "An error was not expected")
+
+	// room for two lines per file
+	sink, err := NewFileSink(path, int64(len(line)+1)*2)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.NoError(t, sink.Write([]AnalyticsRecord{record, record, record}), "An error was not expected")
+	assert.NoError(t, sink.Close(), "An error was not expected")
+
+	assert.ErrorIs(t, sink.Write([]AnalyticsRecord{record}), os.ErrClosed, "Writes after close should fail")
+
+	rotated, err := filepath.Glob(filepath.Join(filepath.Dir(path), "analytics-*.json"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Len(t, rotated, 1, "File should be rotated once")
+
+	assert.Equal(t, 2, countLines(t, rotated[0]), "Rotated file should be full")
+	assert.Equal(t, 1, countLines(t, path), "Current file should have the rest")
+
+	file, err := os.Open(path)
+	assert.NoError(t, err, "An error was not expected")
+	defer file.Close()
+
+	var decoded AnalyticsRecord
+	assert.NoError(t, json.NewDecoder(file).Decode(&decoded), "An error was not expected")
+	assert.Equal(t, "/index/1/1", decoded.Path, "Path should match")
+	assert.Equal(t, "10.0.0.1", decoded.IP, "IP should match")
+
+	// a file from another day is rotated before anything is added to it
+	yesterday := time.Now().AddDate(0, 0, -1)
+	assert.NoError(t, os.Chtimes(path, yesterday, yesterday), "An error was not expected")
+
+	sink, err = NewFileSink(path, 0)
+	assert.NoError(t, err, "An error was not expected")
+	assert.NoError(t, sink.Write([]AnalyticsRecord{record}), "An error was not expected")
+	assert.NoError(t, sink.Close(), "An error was not expected")
+
+	rotated, err = filepath.Glob(filepath.Join(filepath.Dir(path), "analytics-*.json"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Len(t, rotated, 2, "File should be rotated for the new day")
+	assert.Equal(t, 1, countLines(t, path), "Current file should only have today")
+}
+
+func TestRedisStreamSink(t *testing.T) {
+	redis.NewRedisMock()
+
+	var added [][]any
+
+	redis.Cache.Mock.GenericCommand("XADD").Handle(func(args []any) (any, error) {
+		added = append(added, args)
+		return "1-0", nil
+	})
+
+	sink := NewRedisStreamSink("analytics", 1000)
+
+	err := sink.Write([]AnalyticsRecord{
+		{Ib: "1", Path: "/index/1/1", Status: 200, Cached: true},
+		{Ib: "2", Path: "/index/2/1", Status: 404},
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	if assert.Len(t, added, 2, "Both records should be added") {
+		assert.Equal(t, []any{"analytics", "MAXLEN", "~", int64(1000), "*", "ib", "1"}, added[0][:7], "Stream and trim should match")
+		assert.Contains(t, added[0], "true", "Cached should be set")
+		assert.Contains(t, added[1], "/index/2/1", "Path should match")
+	}
+}
+
+func TestMultiSink(t *testing.T) {
+	first := &errorSink{err: errors.New("first is gone")}
+	second := &errorSink{}
+
+	sink := MultiSink{first, second}
+
+	err := sink.Write([]AnalyticsRecord{{Ib: "1"}})
+	assert.ErrorIs(t, err, first.err, "Error should be returned")
+
+	assert.NoError(t, sink.Close(), "An error was not expected")
+	assert.True(t, first.closed, "Sink should be closed")
+	assert.True(t, second.closed, "Sink should be closed")
+}
+
+func TestMySQLSinkDatabaseOpen(t *testing.T) {
+	DatabaseCircuitBreaker.Force(StateOpen)
+	defer func() { DatabaseCircuitBreaker = NewCircuitBreaker() }()
+
+	// the database is not touched while the breaker is open
+	err := NewMySQLSink().Write([]AnalyticsRecord{{Ib: "1"}})
+	assert.ErrorIs(t, err, errDatabaseOpen, "Error should match")
+}
+
+// countLines returns the number of lines in a file
+func countLines(t *testing.T, path string) int {
+	file, err := os.Open(path)
+	assert.NoError(t, err, "An error was not expected")
+	defer file.Close()
+
+	lines := 0
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		lines++
+	}
+
+	return lines
+}
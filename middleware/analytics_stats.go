@@ -0,0 +1,347 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// statsLatencyBounds are the upper bounds in milliseconds of the latency
+// histogram buckets, slower requests go into one more bucket
+var statsLatencyBounds = []float64{1, 2, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// statsTopItems are the item keys ranked in the top lists of a board
+var statsTopItems = map[string]bool{
+	"thread": true,
+	"tag":    true,
+}
+
+// statsTopSize is how many items the top lists hold
+const statsTopSize = 10
+
+// StatsWindow is a span of time the stats are reported over
+type StatsWindow struct {
+	// Buckets is how many hours or days the window covers
+	Buckets int
+	// Hourly reports the window in hours instead of days
+	Hourly bool
+}
+
+// StatsWindows are the windows the stats can be reported over
+var StatsWindows = map[string]StatsWindow{
+	"day":   {Buckets: 24, Hourly: true},
+	"week":  {Buckets: 7},
+	"month": {Buckets: 30},
+}
+
+// Stats is the traffic of a board, thread or tag over a window
+type Stats struct {
+	Window        string        `json:"window"`
+	Requests      int64         `json:"requests"`
+	Cached        int64         `json:"cached"`
+	CacheHitRatio float64       `json:"cache_hit_ratio"`
+	LatencyP50    float64       `json:"latency_p50_ms"`
+	LatencyP95    float64       `json:"latency_p95_ms"`
+	Series        []StatsBucket `json:"series"`
+	TopThreads    []StatsItem   `json:"top_threads,omitempty"`
+	TopTags       []StatsItem   `json:"top_tags,omitempty"`
+}
+
+// StatsBucket is the traffic of one hour or day, oldest first
+type StatsBucket struct {
+	Time     time.Time `json:"time"`
+	Requests int64     `json:"requests"`
+	Cached   int64     `json:"cached"`
+}
+
+// StatsItem is a thread or tag and its requests
+type StatsItem struct {
+	ID       string `json:"id"`
+	Requests int64  `json:"requests"`
+}
+
+// StatsSink rolls requests from people up into hourly and daily counters in Redis
+// for each board and for each thread and tag, so reports never scan the analytics
+// table. Hourly counters are kept for two days and daily ones for a month.
+type StatsSink struct{}
+
+// NewStatsSink returns a sink rolling requests up into Redis counters
+func NewStatsSink() *StatsSink {
+	return &StatsSink{}
+}
+
+// Write adds the records to the counters in a single pipeline
+func (s *StatsSink) Write(records []AnalyticsRecord) error {
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	// every key gets its expiry once per batch
+	expires := make(map[string]time.Duration)
+
+	sent := 0
+
+	send := func(command string, args ...any) {
+		conn.Send(command, args...)
+		sent++
+	}
+
+	for _, record := range records {
+		if record.Bot || record.Ib == "" {
+			continue
+		}
+
+		latency := "latency:" + strconv.Itoa(latencyBucket(record.Latency))
+
+		scopes := []string{"board"}
+		if statsTopItems[record.ItemKey] && record.Status == http.StatusOK {
+			scopes = append(scopes, record.ItemKey+":"+record.ItemValue)
+		}
+
+		for _, hourly := range []bool{true, false} {
+			bucket, ttl := statsBucket(record.Time, hourly)
+
+			for _, scope := range scopes {
+				key := statsKey(record.Ib, scope, bucket)
+
+				send("HINCRBY", key, "requests", 1)
+				send("HINCRBY", key, latency, 1)
+				if record.Cached {
+					send("HINCRBY", key, "cached", 1)
+				}
+
+				expires[key] = ttl
+			}
+
+			if len(scopes) > 1 {
+				key := statsKey(record.Ib, "top:"+record.ItemKey, bucket)
+
+				send("ZINCRBY", key, 1, record.ItemValue)
+
+				expires[key] = ttl
+			}
+		}
+	}
+
+	for key, ttl := range expires {
+		send("EXPIRE", key, int(ttl/time.Second))
+	}
+
+	if sent == 0 {
+		return nil
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for range sent {
+		if _, err := conn.Receive(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close does nothing, the Redis pool is shared
+func (s *StatsSink) Close() error {
+	return nil
+}
+
+// BoardStats returns the traffic of a board scope over a window up to now. The
+// scope is board for the whole board, or thread:id and tag:id, and only the
+// board has top lists.
+func BoardStats(ib, scope, window string, now time.Time) (stats Stats, err error) {
+	span, ok := StatsWindows[window]
+	if !ok {
+		return stats, fmt.Errorf("unknown stats window %q", window)
+	}
+
+	stats.Window = window
+	stats.Series = make([]StatsBucket, span.Buckets)
+
+	histogram := make([]int64, len(statsLatencyBounds)+1)
+
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	for i := range stats.Series {
+		bucket := statsStart(now, span.Hourly, span.Buckets-1-i)
+
+		stats.Series[i].Time = bucket
+
+		name, _ := statsBucket(bucket, span.Hourly)
+
+		var fields map[string]int64
+
+		fields, err = redigo.Int64Map(conn.Do("HGETALL", statsKey(ib, scope, name)))
+		if err != nil {
+			return
+		}
+
+		for field, count := range fields {
+			switch field {
+			case "requests":
+				stats.Series[i].Requests = count
+			case "cached":
+				stats.Series[i].Cached = count
+			default:
+				var index int
+				if _, scanErr := fmt.Sscanf(field, "latency:%d", &index); scanErr == nil && index >= 0 && index < len(histogram) {
+					histogram[index] += count
+				}
+			}
+		}
+
+		stats.Requests += stats.Series[i].Requests
+		stats.Cached += stats.Series[i].Cached
+	}
+
+	if stats.Requests > 0 {
+		stats.CacheHitRatio = float64(stats.Cached) / float64(stats.Requests)
+	}
+
+	stats.LatencyP50 = latencyPercentile(histogram, 0.5)
+	stats.LatencyP95 = latencyPercentile(histogram, 0.95)
+
+	if scope != "board" {
+		return
+	}
+
+	stats.TopThreads, err = statsTop(conn, ib, "thread", span, now)
+	if err != nil {
+		return
+	}
+
+	stats.TopTags, err = statsTop(conn, ib, "tag", span, now)
+
+	return
+}
+
+// statsTop returns the items with the most requests in a window, the buckets
+// are summed into a temporary key that is removed right after
+func statsTop(conn redigo.Conn, ib, item string, span StatsWindow, now time.Time) ([]StatsItem, error) {
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+
+	temp := statsKey(ib, "top:"+item, "tmp:"+hex.EncodeToString(suffix))
+
+	args := []any{temp, span.Buckets}
+
+	for i := range span.Buckets {
+		name, _ := statsBucket(statsStart(now, span.Hourly, i), span.Hourly)
+		args = append(args, statsKey(ib, "top:"+item, name))
+	}
+
+	conn.Send("ZUNIONSTORE", args...)
+	conn.Send("ZREVRANGE", temp, 0, statsTopSize-1, "WITHSCORES")
+	conn.Send("DEL", temp)
+
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Receive(); err != nil {
+		return nil, err
+	}
+
+	values, rangeErr := redigo.Values(conn.Receive())
+
+	if _, err := conn.Receive(); err != nil || rangeErr != nil {
+		return nil, errors.Join(rangeErr, err)
+	}
+
+	var top []StatsItem
+
+	for i := 0; i+1 < len(values); i += 2 {
+		id, err := redigo.String(values[i], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		score, err := redigo.Float64(values[i+1], nil)
+		if err != nil {
+			return nil, err
+		}
+
+		top = append(top, StatsItem{ID: id, Requests: int64(score)})
+	}
+
+	return top, nil
+}
+
+// statsKey returns the key of a scope of a board for a bucket
+func statsKey(ib, scope, bucket string) string {
+	return fmt.Sprintf("stats:%s:%s:%s", ib, scope, bucket)
+}
+
+// statsBucket returns the name of the UTC hour or day of a time and how long
+// its counters are kept
+func statsBucket(t time.Time, hourly bool) (string, time.Duration) {
+	if hourly {
+		return "h:" + t.UTC().Format("2006010215"), 48 * time.Hour
+	}
+
+	return "d:" + t.UTC().Format("20060102"), 31 * 24 * time.Hour
+}
+
+// statsStart returns the start of the UTC hour or day a number of buckets before now
+func statsStart(now time.Time, hourly bool, ago int) time.Time {
+	now = now.UTC()
+
+	if hourly {
+		return now.Truncate(time.Hour).Add(-time.Duration(ago) * time.Hour)
+	}
+
+	return time.Date(now.Year(), now.Month(), now.Day()-ago, 0, 0, 0, 0, time.UTC)
+}
+
+// latencyBucket returns the histogram bucket of a latency
+func latencyBucket(latency time.Duration) int {
+	ms := float64(latency) / float64(time.Millisecond)
+
+	for i, bound := range statsLatencyBounds {
+		if ms <= bound {
+			return i
+		}
+	}
+
+	return len(statsLatencyBounds)
+}
+
+// latencyPercentile returns the upper bound in milliseconds of the bucket holding
+// the percentile, requests slower than the last bound report the last bound
+func latencyPercentile(histogram []int64, percentile float64) float64 {
+	var total int64
+	for _, count := range histogram {
+		total += count
+	}
+
+	if total == 0 {
+		return 0
+	}
+
+	target := int64(math.Ceil(percentile * float64(total)))
+
+	var seen int64
+
+	for i, count := range histogram {
+		seen += count
+		if seen >= target {
+			return statsLatencyBounds[min(i, len(statsLatencyBounds)-1)]
+		}
+	}
+
+	return statsLatencyBounds[len(statsLatencyBounds)-1]
+}
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsSink(t *testing.T) {
+	redis.NewRedisMock()
+
+	now := time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)
+
+	counts := make(map[string]map[string]int)
+	top := make(map[string][]any)
+	expires := make(map[string]any)
+
+	redis.Cache.Mock.GenericCommand("HINCRBY").Handle(func(args []any) (any, error) {
+		key := args[0].(string)
+		if counts[key] == nil {
+			counts[key] = make(map[string]int)
+		}
+		counts[key][args[1].(string)]++
+		return int64(1), nil
+	})
+	redis.Cache.Mock.GenericCommand("ZINCRBY").Handle(func(args []any) (any, error) {
+		key := args[0].(string)
+		top[key] = append(top[key], args[2])
+		return []byte("1"), nil
+	})
+	redis.Cache.Mock.GenericCommand("EXPIRE").Handle(func(args []any) (any, error) {
+		expires[args[0].(string)] = args[1]
+		return int64(1), nil
+	})
+
+	err := NewStatsSink().Write([]AnalyticsRecord{
+		{Ib: "1", ItemKey: "thread", ItemValue: "3", Status: 200, Latency: 3 * time.Millisecond, Cached: true, Time: now},
+		{Ib: "1", ItemKey: "index", ItemValue: "1", Status: 200, Latency: 80 * time.Millisecond, Time: now},
+		{Ib: "1", ItemKey: "thread", ItemValue: "3", Status: 200, Bot: true, Time: now},
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	// bots are not counted
+	assert.Equal(t, map[string]int{"requests": 2, "cached": 1, "latency:2": 1, "latency:6": 1}, counts["stats:1:board:h:2026101712"], "Board hour should match")
+	assert.Equal(t, map[string]int{"requests": 2, "cached": 1, "latency:2": 1, "latency:6": 1}, counts["stats:1:board:d:20261017"], "Board day should match")
+	assert.Equal(t, map[string]int{"requests": 1, "cached": 1, "latency:2": 1}, counts["stats:1:thread:3:d:20261017"], "Thread day should match")
+	assert.Equal(t, []any{"3"}, top["stats:1:top:thread:h:2026101712"], "Top threads should match")
+
+	assert.Equal(t, 48*60*60, expires["stats:1:board:h:2026101712"], "Hourly counters should expire")
+	assert.Equal(t, 31*24*60*60, expires["stats:1:top:thread:d:20261017"], "Daily counters should expire")
+	assert.Len(t, expires, 6, "Every key should expire once")
+}
+
+func TestBoardStats(t *testing.T) {
+	redis.NewRedisMock()
+
+	now := time.Date(2026, 10, 17, 12, 30, 0, 0, time.UTC)
+
+	buckets := map[string][]any{
+		"stats:1:board:d:20261017": {[]byte("requests"), []byte("3"), []byte("cached"), []byte("2"), []byte("latency:2"), []byte("2"), []byte("latency:8"), []byte("1")},
+		"stats:1:board:d:20261015": {[]byte("requests"), []byte("1"), []byte("latency:2"), []byte("1")},
+	}
+
+	redis.Cache.Mock.GenericCommand("HGETALL").Handle(func(args []any) (any, error) {
+		return buckets[args[0].(string)], nil
+	})
+
+	var unions [][]any
+
+	redis.Cache.Mock.GenericCommand("ZUNIONSTORE").Handle(func(args []any) (any, error) {
+		unions = append(unions, args)
+		return int64(1), nil
+	})
+	redis.Cache.Mock.GenericCommand("ZREVRANGE").Expect([]any{[]byte("3"), []byte("7"), []byte("5"), []byte("2")})
+	redis.Cache.Mock.GenericCommand("DEL").Expect(int64(1))
+
+	stats, err := BoardStats("1", "board", "week", now)
+	assert.NoError(t, err, "An error was not expected")
+
+	assert.Equal(t, "week", stats.Window, "Window should match")
+	assert.Equal(t, int64(4), stats.Requests, "Requests should match")
+	assert.Equal(t, 0.5, stats.CacheHitRatio, "Cache hit ratio should match")
+	assert.Equal(t, float64(5), stats.LatencyP50, "p50 should match")
+	assert.Equal(t, float64(500), stats.LatencyP95, "p95 should match")
+
+	if assert.Len(t, stats.Series, 7, "Series should cover the window") {
+		assert.Equal(t, time.Date(2026, 10, 11, 0, 0, 0, 0, time.UTC), stats.Series[0].Time, "Series should start with the oldest day")
+		assert.Equal(t, int64(1), stats.Series[4].Requests, "Day should match")
+		assert.Equal(t, int64(3), stats.Series[6].Requests, "Today should match")
+	}
+
+	assert.Equal(t, []StatsItem{{ID: "3", Requests: 7}, {ID: "5", Requests: 2}}, stats.TopThreads, "Top threads should match")
+
+	if assert.Len(t, unions, 2, "Threads and tags should be ranked") {
+		assert.Equal(t, 7, unions[0][1], "Every day should be summed")
+		assert.Equal(t, "stats:1:top:thread:d:20261017", unions[0][2], "Top key should match")
+	}
+
+	// items have no top lists
+	stats, err = BoardStats("1", "thread:3", "day", now)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Len(t, stats.Series, 24, "Series should cover the window")
+	assert.Nil(t, stats.TopThreads, "Items should not have top lists")
+
+	_, err = BoardStats("1", "board", "year", now)
+	assert.Error(t, err, "An error was expected")
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	assert.Equal(t, 0, latencyBucket(500*time.Microsecond), "Bucket should match")
+	assert.Equal(t, 6, latencyBucket(100*time.Millisecond), "Bucket should match")
+	assert.Equal(t, len(statsLatencyBounds), latencyBucket(time.Minute), "Slow requests should go past the last bound")
+
+	assert.Equal(t, float64(0), latencyPercentile(make([]int64, 3), 0.5), "Empty histograms should be zero")
+	assert.Equal(t, float64(10000), latencyPercentile([]int64{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 0.95), "Slow requests should report the last bound")
+}
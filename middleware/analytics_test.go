@@ -3,7 +3,9 @@ package middleware
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 
@@ -72,6 +74,14 @@ func TestAnalytics(t *testing.T) {
 	mock, err := db.NewTestDb()
 	assert.NoError(t, err, "An error was not expected")
 
+	// hold the records in the queue
+	AnalyticsQueue = NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     10,
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+	})
+	defer func() { AnalyticsQueue = NewAnalyticsWriter() }()
+
 	cached := performRequest(router, "GET", "/index/1/2")
 
 	assert.Equal(t, cached.Code, 200, "HTTP request code should match")
@@ -84,32 +94,59 @@ func TestAnalytics(t *testing.T) {
 
 	assert.Equal(t, bad.Code, 500, "HTTP request code should match")
 
+	// only the index page is recorded
+	assert.Equal(t, uint64(1), AnalyticsQueue.Stats().Queued, "Queued records should match")
+
 	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
 
 }
 
-func TestInsertRecord(t *testing.T) {
+func TestInsertRecords(t *testing.T) {
 
 	mock, err := db.NewTestDb()
 	assert.NoError(t, err, "An error was not expected")
 
-	mock.ExpectExec(`INSERT INTO analytics`).
-		WithArgs("1", 1, "123.0.0.1", "/index/1/2", 200, 500, "index", "2", false).
-		WillReturnResult(sqlmock.NewResult(1, 1))
-
-	request := requestType{
-		Ib:        "1",
-		IP:        "123.0.0.1",
-		User:      1,
-		Path:      "/index/1/2",
-		ItemKey:   "index",
-		ItemValue: "2",
-		Status:    200,
-		Latency:   500,
-		Cached:    false,
+	now := time.Now()
+
+	mock.ExpectExec(`INSERT INTO analytics .* VALUES \(\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,NOW\(\)\),\(\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,\?,NOW\(\)\)`).
+		WithArgs("1", 1, "123.0.0.1", "/index/1/2", 200, 500, "index", "2", false, false, false, "google.com", "firefox", "desktop",
+			"1", 0, "123.0.0.2", "/thread/1/3/1", 200, 100, "thread", "1", true, true, false, "", "bot", "bot").
+		WillReturnResult(sqlmock.NewResult(1, 2))
+
+	records := []AnalyticsRecord{
+		{
+			Ib:        "1",
+			IP:        "123.0.0.1",
+			User:      1,
+			Path:      "/index/1/2",
+			ItemKey:   "index",
+			ItemValue: "2",
+			Status:    200,
+			Latency:   500,
+			Cached:    false,
+			Referrer:  "google.com",
+			Browser:   "firefox",
+			Device:    "desktop",
+			Time:      now,
+		},
+		{
+			Ib:        "1",
+			IP:        "123.0.0.2",
+			User:      0,
+			Path:      "/thread/1/3/1",
+			ItemKey:   "thread",
+			ItemValue: "1",
+			Status:    200,
+			Latency:   100,
+			Cached:    true,
+			Bot:       true,
+			Browser:   "bot",
+			Device:    "bot",
+			Time:      now,
+		},
 	}
 
-	err = insertRecord(request)
+	err = insertRecords(records)
 	assert.NoError(t, err, "An error was not expected")
 
 	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
@@ -118,8 +155,101 @@ func TestInsertRecord(t *testing.T) {
 
 func TestGenerateKey(t *testing.T) {
 
-	key := generateKey("/index/1/2")
+	gin.SetMode(gin.ReleaseMode)
+
+	var key itemKey
+	var recorded bool
+
+	router := gin.New()
+
+	router.Use(func(c *gin.Context) {
+		key, recorded = generateKey(c)
+	})
+
+	for _, route := range []string{
+		"/index/:ib/:page",
+		"/thread/:ib/:thread/:page",
+		"/post/:ib/:thread/:id",
+		"/image/:ib/:id",
+		"/random/image/:ib",
+		"/new/:ib",
+		"/tagsearch/:ib",
+		"/threadsearch/:ib",
+		"/tagtypes",
+	} {
+		router.GET(route, func(c *gin.Context) {})
+	}
+
+	tests := []struct {
+		path  string
+		key   string
+		value string
+	}{
+		{"/index/1/2", "index", "2"},
+		{"/thread/1/3/2", "thread", "3"},
+		{"/post/1/3/12", "post", "3:12"},
+		{"/image/1/40", "image", "40"},
+		{"/random/image/1", "random", "image"},
+		{"/new/1", "new", "1"},
+		{"/tagsearch/1?search=Touhou%20%20Reimu-", "tagsearch", "touhou reimu"},
+		{"/threadsearch/1?search=" + strings.Repeat("a", 100), "threadsearch", strings.Repeat("a", searchTermMaxLength)},
+	}
+
+	for _, test := range tests {
+		performRequest(router, "GET", test.path)
+
+		assert.True(t, recorded, "Route should be recorded for %s", test.path)
+		assert.Equal(t, test.key, key.Key, "Key should match for %s", test.path)
+		assert.Equal(t, test.value, key.Value, "Value should match for %s", test.path)
+	}
+
+	performRequest(router, "GET", "/tagtypes")
+	assert.False(t, recorded, "Route should not be recorded")
+}
+
+func TestAnalyticsEmptySearch(t *testing.T) {
+
+	gin.SetMode(gin.ReleaseMode)
+
+	config.Settings.Session.NewSecret = "secret"
+
+	router := gin.New()
+
+	router.Use(validate.ValidateParams())
+	router.Use(user.Auth(false))
+	router.Use(Analytics())
+	router.Use(testCache())
+
+	router.GET("/tagsearch/:ib", func(c *gin.Context) {
+		if c.Query("search") == "nothing" {
+			c.Data(200, "application/json", []byte(`{"tagsearch":[]}`))
+			return
+		}
+
+		c.Data(200, "application/json", []byte(`{"tagsearch":[{"id":1,"tag":"touhou"}]}`))
+	})
+
+	// hold the records in the queue and keep the worker off so they can be read back
+	AnalyticsQueue = NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     10,
+		BatchSize:     10,
+		FlushInterval: time.Hour,
+	})
+	defer func() { AnalyticsQueue = NewAnalyticsWriter() }()
+
+	AnalyticsQueue.start.Do(func() {})
+
+	found := performRequest(router, "GET", "/tagsearch/1?search=Touhou")
+	assert.Equal(t, `{"tagsearch":[{"id":1,"tag":"touhou"}]}`, found.Body.String(), "Body should match")
+
+	empty := performRequest(router, "GET", "/tagsearch/1?search=nothing")
+	assert.Equal(t, `{"tagsearch":[]}`, empty.Body.String(), "Body should match")
+
+	record := <-AnalyticsQueue.queue
+	assert.Equal(t, "touhou", record.ItemValue, "Search term should match")
+	assert.False(t, record.Empty, "Search should have found something")
 
-	assert.Equal(t, key.Key, "index", "Key should match")
-	assert.Equal(t, key.Value, "2", "Value should match")
+	record = <-AnalyticsQueue.queue
+	assert.Equal(t, "nothing", record.ItemValue, "Search term should match")
+	assert.True(t, record.Empty, "Search should have found nothing")
 }
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// MaxViewDays is how many days of views are kept for each item
+const MaxViewDays = 30
+
+// viewItems are the item keys whose views are counted
+var viewItems = map[string]bool{
+	"thread": true,
+	"image":  true,
+}
+
+// ViewCounts are the views of an item over a number of days
+type ViewCounts struct {
+	Days   int   `json:"days"`
+	Views  int64 `json:"views"`
+	Unique int64 `json:"unique"`
+}
+
+// ViewSink counts the views and unique visitors of threads and images in Redis.
+// Views are a counter and visitors a HyperLogLog per item and UTC day, so the
+// unique count of several days is the estimate of their union.
+type ViewSink struct{}
+
+// NewViewSink returns a sink counting item views in Redis
+func NewViewSink() *ViewSink {
+	return &ViewSink{}
+}
+
+// Write counts the successful requests from people for threads and images in a
+// single pipeline
+func (s *ViewSink) Write(records []AnalyticsRecord) error {
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	// keys outlive the days they are read for
+	ttl := int((MaxViewDays + 1) * 24 * time.Hour / time.Second)
+
+	sent := 0
+
+	for _, record := range records {
+		if record.Bot || record.Status != http.StatusOK || !viewItems[record.ItemKey] {
+			continue
+		}
+
+		views, visitors := viewKeys(record.Ib, record.ItemKey, record.ItemValue, record.Time)
+
+		conn.Send("INCR", views)
+		conn.Send("EXPIRE", views, ttl)
+		sent += 2
+
+		if visitor := viewVisitor(record); visitor != "" {
+			conn.Send("PFADD", visitors, visitor)
+			conn.Send("EXPIRE", visitors, ttl)
+			sent += 2
+		}
+	}
+
+	if sent == 0 {
+		return nil
+	}
+
+	if err := conn.Flush(); err != nil {
+		return err
+	}
+
+	var errs []error
+
+	for range sent {
+		if _, err := conn.Receive(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close does nothing, the Redis pool is shared
+func (s *ViewSink) Close() error {
+	return nil
+}
+
+// ItemViews returns the views and estimated unique visitors of an item over the
+// last days up to now, today included
+func ItemViews(ib, item, id string, days int, now time.Time) (counts ViewCounts, err error) {
+	counts.Days = min(max(days, 1), MaxViewDays)
+
+	views := make([]any, counts.Days)
+	visitors := make([]any, counts.Days)
+
+	for day := range counts.Days {
+		views[day], visitors[day] = viewKeys(ib, item, id, now.AddDate(0, 0, -day))
+	}
+
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	daily, err := redigo.Int64s(conn.Do("MGET", views...))
+	if err != nil {
+		return
+	}
+
+	for _, count := range daily {
+		counts.Views += count
+	}
+
+	counts.Unique, err = redigo.Int64(conn.Do("PFCOUNT", visitors...))
+
+	return
+}
+
+// viewKeys returns the view counter and visitor keys of an item for the UTC day of the time
+func viewKeys(ib, item, id string, t time.Time) (views, visitors string) {
+	day := t.UTC().Format("20060102")
+
+	views = fmt.Sprintf("views:%s:%s:%s:%s", ib, item, id, day)
+	visitors = fmt.Sprintf("visitors:%s:%s:%s:%s", ib, item, id, day)
+
+	return
+}
+
+// viewVisitor returns who made a request, signed in users by their account and
+// guests by their stored address, which is already anonymized if configured
+func viewVisitor(record AnalyticsRecord) string {
+	if record.User > 1 {
+		return fmt.Sprintf("user:%d", record.User)
+	}
+
+	if record.IP == "" {
+		return ""
+	}
+
+	return "ip:" + record.IP
+}
@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestViewSink(t *testing.T) {
+	redis.NewRedisMock()
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	var incr, pfadd [][]any
+
+	redis.Cache.Mock.GenericCommand("INCR").Handle(func(args []any) (any, error) {
+		incr = append(incr, args)
+		return int64(1), nil
+	})
+	redis.Cache.Mock.GenericCommand("PFADD").Handle(func(args []any) (any, error) {
+		pfadd = append(pfadd, args)
+		return int64(1), nil
+	})
+	redis.Cache.Mock.GenericCommand("EXPIRE").Expect(int64(1))
+
+	err := NewViewSink().Write([]AnalyticsRecord{
+		{Ib: "1", ItemKey: "thread", ItemValue: "3", Status: 200, IP: "10.0.0.1", User: 1, Time: now},
+		{Ib: "1", ItemKey: "image", ItemValue: "40", Status: 200, User: 2, Time: now},
+		{Ib: "1", ItemKey: "thread", ItemValue: "3", Status: 200, Bot: true, Time: now},
+		{Ib: "1", ItemKey: "thread", ItemValue: "4", Status: 404, Time: now},
+		{Ib: "1", ItemKey: "index", ItemValue: "1", Status: 200, Time: now},
+	})
+	assert.NoError(t, err, "An error was not expected")
+
+	// bots, errors and other pages are not counted
+	assert.Equal(t, [][]any{{"views:1:thread:3:20261017"}, {"views:1:image:40:20261017"}}, incr, "Views should match")
+	assert.Equal(t, [][]any{
+		{"visitors:1:thread:3:20261017", "ip:10.0.0.1"},
+		{"visitors:1:image:40:20261017", "user:2"},
+	}, pfadd, "Visitors should match")
+}
+
+func TestItemViews(t *testing.T) {
+	redis.NewRedisMock()
+
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	redis.Cache.Mock.Command("MGET", "views:1:thread:3:20261017", "views:1:thread:3:20261016").
+		Expect([]any{[]byte("5"), nil})
+	redis.Cache.Mock.Command("PFCOUNT", "visitors:1:thread:3:20261017", "visitors:1:thread:3:20261016").
+		Expect(int64(3))
+
+	counts, err := ItemViews("1", "thread", "3", 2, now)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, ViewCounts{Days: 2, Views: 5, Unique: 3}, counts, "Counts should match")
+}
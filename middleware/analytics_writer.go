@@ -0,0 +1,283 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// AnalyticsWriterConfig holds the configuration for the analytics writer
+type AnalyticsWriterConfig struct {
+	// QueueSize is how many records wait for the writer before new ones are dropped
+	QueueSize int
+	// BatchSize is how many records go into one INSERT
+	BatchSize int
+	// FlushInterval is how long a partial batch waits before it is written
+	FlushInterval time.Duration
+	// Sink is where the batches are written, the analytics table if nil
+	Sink AnalyticsSink
+}
+
+// DefaultAnalyticsWriterConfig provides sensible defaults for the analytics writer
+var DefaultAnalyticsWriterConfig = AnalyticsWriterConfig{
+	QueueSize:     10000,
+	BatchSize:     500,
+	FlushInterval: time.Second,
+}
+
+// AnalyticsQueue is the writer the analytics middleware hands its records to
+var AnalyticsQueue = NewAnalyticsWriter()
+
+// AnalyticsWriter writes analytics records to a sink in batches from a single
+// worker, so a traffic spike costs queue space instead of database connections.
+// Records that do not fit in the queue are dropped and counted, a request never
+// waits on analytics.
+type AnalyticsWriter struct {
+	config AnalyticsWriterConfig
+	queue  chan AnalyticsRecord
+	start  sync.Once
+	done   chan struct{}
+
+	// mutex guards closing the queue against records still being added
+	mutex  sync.RWMutex
+	closed bool
+
+	// sinks are the sinks batches go to, a MultiSink is written one sink at a time
+	// so each keeps its own counts
+	sinks []*writerSink
+
+	queued   atomic.Uint64
+	dropped  atomic.Uint64
+	batches  atomic.Uint64
+	maxDepth atomic.Int64
+	flush    atomic.Int64
+}
+
+// writerSink is a sink and the outcome of the batches written to it
+type writerSink struct {
+	name    string
+	sink    AnalyticsSink
+	written atomic.Uint64
+	failed  atomic.Uint64
+	dropped atomic.Uint64
+}
+
+// AnalyticsWriterStats is a snapshot of the analytics writer counters
+type AnalyticsWriterStats struct {
+	Queued uint64 `json:"queued"`
+	// Dropped is how many records never made it into a batch
+	Dropped uint64 `json:"dropped"`
+	// Batches is how many batches were handed to the sinks
+	Batches uint64 `json:"batches"`
+	// Depth is how many records are waiting, out of Capacity
+	Depth    int `json:"depth"`
+	Capacity int `json:"capacity"`
+	// MaxDepth is the deepest the queue has been
+	MaxDepth int `json:"max_depth"`
+	// LastFlush is how long the last batch took to write to every sink
+	LastFlush time.Duration `json:"last_flush"`
+	// Sinks holds the records each sink wrote, failed or held back
+	Sinks []AnalyticsSinkStats `json:"sinks"`
+}
+
+// AnalyticsSinkStats is a snapshot of the counters for one sink
+type AnalyticsSinkStats struct {
+	Name    string `json:"name"`
+	Written uint64 `json:"written"`
+	Failed  uint64 `json:"failed"`
+	// Dropped is how many records the sink held back to spare the database
+	Dropped uint64 `json:"dropped"`
+}
+
+// NewAnalyticsWriter creates a new analytics writer with default configuration
+func NewAnalyticsWriter() *AnalyticsWriter {
+	return NewAnalyticsWriterWithConfig(DefaultAnalyticsWriterConfig)
+}
+
+// NewAnalyticsWriterWithConfig creates a new analytics writer with the given
+// configuration, the worker starts with the first record
+func NewAnalyticsWriterWithConfig(config AnalyticsWriterConfig) *AnalyticsWriter {
+	if config.Sink == nil {
+		config.Sink = NewMySQLSink()
+	}
+
+	w := &AnalyticsWriter{
+		config: config,
+		queue:  make(chan AnalyticsRecord, max(1, config.QueueSize)),
+		done:   make(chan struct{}),
+	}
+
+	for _, sink := range flattenSinks(config.Sink) {
+		w.sinks = append(w.sinks, &writerSink{name: sinkName(sink), sink: sink})
+	}
+
+	return w
+}
+
+// flattenSinks lists the sinks a batch goes to, unpacking nested MultiSinks
+func flattenSinks(sink AnalyticsSink) []AnalyticsSink {
+	multi, ok := sink.(MultiSink)
+	if !ok {
+		return []AnalyticsSink{sink}
+	}
+
+	var sinks []AnalyticsSink
+
+	for _, member := range multi {
+		sinks = append(sinks, flattenSinks(member)...)
+	}
+
+	return sinks
+}
+
+// sinkName is the name a sink is reported under in the writer stats
+func sinkName(sink AnalyticsSink) string {
+	switch sink.(type) {
+	case *MySQLSink:
+		return "mysql"
+	case *FileSink:
+		return "file"
+	case *RedisStreamSink:
+		return "redis"
+	case *ViewSink:
+		return "views"
+	case *StatsSink:
+		return "stats"
+	default:
+		return fmt.Sprintf("%T", sink)
+	}
+}
+
+// Enqueue adds a record to the queue, dropping it if the queue is full or closed
+func (w *AnalyticsWriter) Enqueue(request AnalyticsRecord) {
+	w.start.Do(func() {
+		go w.run()
+	})
+
+	w.mutex.RLock()
+	defer w.mutex.RUnlock()
+
+	if w.closed {
+		w.dropped.Add(1)
+		return
+	}
+
+	select {
+	case w.queue <- request:
+		w.queued.Add(1)
+
+		if depth := int64(len(w.queue)); depth > w.maxDepth.Load() {
+			w.maxDepth.Store(depth)
+		}
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close stops taking records, waits for the queued ones to be written and then
+// closes the sink, it is called once the server has shut down
+func (w *AnalyticsWriter) Close() error {
+	w.mutex.Lock()
+
+	if w.closed {
+		w.mutex.Unlock()
+		return nil
+	}
+
+	w.closed = true
+	close(w.queue)
+	w.mutex.Unlock()
+
+	// Make sure there is a worker to drain the queue
+	w.start.Do(func() {
+		go w.run()
+	})
+
+	<-w.done
+
+	return w.config.Sink.Close()
+}
+
+// Stats returns the writer counters
+func (w *AnalyticsWriter) Stats() AnalyticsWriterStats {
+	stats := AnalyticsWriterStats{
+		Queued:    w.queued.Load(),
+		Dropped:   w.dropped.Load(),
+		Batches:   w.batches.Load(),
+		Depth:     len(w.queue),
+		Capacity:  cap(w.queue),
+		MaxDepth:  int(w.maxDepth.Load()),
+		LastFlush: time.Duration(w.flush.Load()),
+	}
+
+	for _, sink := range w.sinks {
+		stats.Sinks = append(stats.Sinks, AnalyticsSinkStats{
+			Name:    sink.name,
+			Written: sink.written.Load(),
+			Failed:  sink.failed.Load(),
+			Dropped: sink.dropped.Load(),
+		})
+	}
+
+	return stats
+}
+
+// run collects records into batches and writes them when a batch is full, when
+// the flush interval passes, and when the queue is closed
+func (w *AnalyticsWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]AnalyticsRecord, 0, w.config.BatchSize)
+
+	for {
+		select {
+		case request, ok := <-w.queue:
+			if !ok {
+				w.write(batch)
+				return
+			}
+
+			batch = append(batch, request)
+
+			if len(batch) >= w.config.BatchSize {
+				w.write(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			w.write(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// write hands a batch to each sink and counts the outcome per sink, so one sink
+// failing does not count the records the others wrote. Analytics are not worth a retry.
+func (w *AnalyticsWriter) write(batch []AnalyticsRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	start := time.Now()
+
+	for _, sink := range w.sinks {
+		err := sink.sink.Write(batch)
+
+		switch {
+		// Batches held back to spare the database were never attempted
+		case errors.Is(err, errDatabaseOpen):
+			sink.dropped.Add(uint64(len(batch)))
+		case err != nil:
+			sink.failed.Add(uint64(len(batch)))
+		default:
+			sink.written.Add(uint64(len(batch)))
+		}
+	}
+
+	w.flush.Store(int64(time.Since(start)))
+	w.batches.Add(1)
+}
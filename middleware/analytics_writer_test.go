@@ -0,0 +1,134 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gopkg.in/DATA-DOG/go-sqlmock.v1"
+
+	"github.com/eirka/eirka-libs/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnalyticsWriter(t *testing.T) {
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	// a full batch is written at once and the rest on close
+	mock.ExpectExec(`INSERT INTO analytics .*\),\(.*\),\(`).
+		WillReturnResult(sqlmock.NewResult(1, 3))
+	mock.ExpectExec(`INSERT INTO analytics`).
+		WillReturnError(errors.New("database is gone"))
+
+	writer := NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     10,
+		BatchSize:     3,
+		FlushInterval: time.Hour,
+	})
+
+	for range 4 {
+		writer.Enqueue(AnalyticsRecord{Ib: "1", Path: "/index/1/1", ItemKey: "index", ItemValue: "1", Status: 200})
+	}
+
+	writer.Close()
+
+	// records after close are dropped
+	writer.Enqueue(AnalyticsRecord{Ib: "1"})
+	writer.Close()
+
+	stats := writer.Stats()
+	assert.Equal(t, uint64(4), stats.Queued, "Queued records should match")
+	assert.Equal(t, uint64(1), stats.Dropped, "Dropped records should match")
+	assert.Equal(t, uint64(2), stats.Batches, "Batches should match")
+	assert.Equal(t, []AnalyticsSinkStats{{Name: "mysql", Written: 3, Failed: 1}}, stats.Sinks, "Sink counts should match")
+	assert.Equal(t, 10, stats.Capacity, "Capacity should match")
+	assert.Zero(t, stats.Depth, "Queue should be empty")
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
+
+}
+
+func TestAnalyticsWriterInterval(t *testing.T) {
+
+	mock, err := db.NewTestDb()
+	assert.NoError(t, err, "An error was not expected")
+
+	mock.ExpectExec(`INSERT INTO analytics`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	writer := NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     10,
+		BatchSize:     100,
+		FlushInterval: 10 * time.Millisecond,
+	})
+
+	writer.Enqueue(AnalyticsRecord{Ib: "1", Path: "/index/1/1", ItemKey: "index", ItemValue: "1", Status: 200})
+
+	// a partial batch is written once the interval passes
+	assert.Eventually(t, func() bool {
+		return writer.Stats().Sinks[0].Written == 1
+	}, time.Second, 5*time.Millisecond, "Record should be written")
+
+	writer.Close()
+
+	assert.NoError(t, mock.ExpectationsWereMet(), "An error was not expected")
+
+}
+
+func TestAnalyticsWriterFull(t *testing.T) {
+
+	writer := NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     2,
+		BatchSize:     100,
+		FlushInterval: time.Hour,
+	})
+
+	// hold the worker off so the queue fills up
+	writer.start.Do(func() {})
+
+	for range 5 {
+		writer.Enqueue(AnalyticsRecord{Ib: "1"})
+	}
+
+	stats := writer.Stats()
+	assert.Equal(t, uint64(2), stats.Queued, "Queued records should match")
+	assert.Equal(t, uint64(3), stats.Dropped, "Dropped records should match")
+	assert.Equal(t, 2, stats.Depth, "Depth should match")
+	assert.Equal(t, 2, stats.MaxDepth, "Max depth should match")
+
+}
+
+func TestAnalyticsWriterSinks(t *testing.T) {
+
+	DatabaseCircuitBreaker.Force(StateOpen)
+	defer func() { DatabaseCircuitBreaker = NewCircuitBreaker() }()
+
+	broken := &errorSink{err: errors.New("stream is gone")}
+
+	writer := NewAnalyticsWriterWithConfig(AnalyticsWriterConfig{
+		QueueSize:     10,
+		BatchSize:     2,
+		FlushInterval: time.Hour,
+		Sink:          MultiSink{MultiSink{NewMySQLSink(), &errorSink{}}, broken},
+	})
+
+	for range 2 {
+		writer.Enqueue(AnalyticsRecord{Ib: "1"})
+	}
+
+	writer.Close()
+
+	// each sink counts its own outcome for the same batch
+	stats := writer.Stats()
+	assert.Equal(t, uint64(1), stats.Batches, "Batches should match")
+	assert.Zero(t, stats.Dropped, "Dropped records should match")
+	assert.Equal(t, []AnalyticsSinkStats{
+		{Name: "mysql", Dropped: 2},
+		{Name: "*middleware.errorSink", Written: 2},
+		{Name: "*middleware.errorSink", Failed: 2},
+	}, stats.Sinks, "Sink counts should match")
+	assert.True(t, broken.closed, "Sinks should be closed")
+
+}
@@ -1,9 +1,7 @@
 package middleware
 
 import (
-	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -13,7 +11,6 @@ import (
 	"github.com/gin-gonic/gin"
 
 	e "github.com/eirka/eirka-libs/errors"
-	"github.com/eirka/eirka-libs/redis"
 )
 
 // Group is the global singleflight group for cache requests
@@ -22,41 +19,102 @@ var Group = singleflight.Group{}
 // CircuitBreaker is the cache circuit breaker
 var CircuitBreaker = NewCircuitBreaker()
 
+// InMemoryCache is the in-process cache checked before Redis
+var InMemoryCache = NewMemoryCache()
+
+// CacheConfig holds the configuration for the cache middleware
+type CacheConfig struct {
+	// FreshFor is how long an entry is served before it is refreshed in the background,
+	// zero disables stale-while-revalidate and entries stay fresh until invalidated
+	FreshFor time.Duration
+	// FillTimeout bounds how long the controller may run to fill or refresh an entry
+	FillTimeout time.Duration
+	// NotFoundTTL is how long a not found response is cached for, zero disables negative caching
+	NotFoundTTL time.Duration
+	// Encodings are the content codings entries are stored in, in order of preference.
+	// Without any the identity body is stored.
+	Encodings []string
+	// CompressMinSize is the smallest body that is compressed
+	CompressMinSize int
+	// EarlyRefreshBeta scales how early hot entries may be refreshed before FreshFor
+	// runs out, larger values refresh earlier and zero disables early refreshes
+	EarlyRefreshBeta float64
+	// LeaseTTL is how long a fill holds its Redis lease at most, zero disables the lease
+	// and each instance fills its own cache misses
+	LeaseTTL time.Duration
+	// LeaseWait is how long a cache miss waits on a fill running on another instance
+	// before running the controller itself
+	LeaseWait time.Duration
+	// Diagnostics adds the X-Cache headers to responses
+	Diagnostics bool
+	// Namespace separates the entries of deployments that share a Redis server
+	Namespace string
+}
+
+// DefaultCacheConfig provides sensible defaults for the cache middleware
+var DefaultCacheConfig = CacheConfig{
+	FreshFor:         60 * time.Second,
+	FillTimeout:      10 * time.Second,
+	NotFoundTTL:      30 * time.Second,
+	Encodings:        []string{encodingBrotli, encodingGzip},
+	CompressMinSize:  1024,
+	EarlyRefreshBeta: 1,
+	LeaseWait:        2 * time.Second,
+}
+
 // Cache is a middleware that implements Redis caching with singleflight pattern and
 // circuit breaker for resilience. It works as follows:
 //
-//  1. First checks if the circuit breaker allows using Redis (bypasses cache if Redis is failing)
-//  2. When a request comes in, it checks if the response is in Redis cache
-//  3. If found in cache, it serves the cached response immediately
+//  1. First checks the in-process memory cache which holds hot responses for a few seconds
+//  2. Then checks if the circuit breaker allows using Redis (bypasses cache if Redis is failing)
+//     and if so whether the response is in Redis cache
+//  3. If found in cache, it serves the cached response immediately, and if the entry
+//     is past its freshness window a single background refresh rebuilds it
 //  4. If not in cache, it uses singleflight to ensure only ONE database query is made
 //     regardless of how many concurrent requests are trying to access the same resource
-//  5. All concurrent requests for the same resource wait for the first one to complete
-//  6. Once the data is retrieved, it's cached in Redis and returned to all waiting clients
+//  5. All concurrent requests for the same resource wait for the first one to complete,
+//     which runs the controller against a detached recorder with its own deadline.
+//     With a lease configured, the first request also takes a Redis lease so requests
+//     on other instances wait for its entry too.
+//  6. Once the response is recorded it is returned to all waiting clients with its real
+//     status and an ETag, so clients that already hold that version get a 304 Not Modified.
+//     Successful responses are cached in Redis, and not found responses are cached with
+//     a short expiry so lookups of missing resources skip the database.
 //  7. Redis failures are tracked by the circuit breaker which will temporarily bypass
 //     the cache if Redis is experiencing problems
 //
 // This approach significantly reduces database load under high concurrency while
 // maintaining responsiveness for clients even when Redis is experiencing issues.
+// Entries are kept in the cache Store, which is Redis unless the install runs without it.
 func Cache() gin.HandlerFunc {
+	return CacheWithConfig(DefaultCacheConfig)
+}
+
+// CacheWithConfig returns the cache middleware with the given configuration
+func CacheWithConfig(config CacheConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Set default cached status for analytics middleware
 		c.Set("cached", false)
 		// Set circuit breaker state for analytics/monitoring
 		c.Set("circuitState", CircuitBreaker.State())
 
-		// Skip caching for requests with query parameters
-		// This ensures dynamic queries aren't incorrectly cached
-		if c.Request.URL.RawQuery != "" {
-			c.Next()
-			return
-		}
-
 		// Parse the request path to generate the cache key
 		// Example: "/index/1/2" becomes ["index", "1", "2"]
 		request := strings.Split(strings.Trim(c.Request.URL.Path, "/"), "/")
 
 		// Skip caching for empty paths
 		if len(request) == 0 {
+			setDiagnostics(c, config, cacheBypass, CacheKey{}, nil)
+			c.Next()
+			return
+		}
+
+		// Get the canonical query the request is cached under
+		// Requests with query parameters the route does not declare bypass the cache
+		// so dynamic queries aren't incorrectly cached
+		query, ok := cacheQuery(request[0], c.Request.URL.Query())
+		if !ok {
+			setDiagnostics(c, config, cacheBypass, CacheKey{}, nil)
 			c.Next()
 			return
 		}
@@ -74,23 +132,55 @@ func Cache() gin.HandlerFunc {
 		// controllers/post.go
 		// controllers/tag.go
 		// controllers/tags.go
+		// controllers/tagsearch.go
 		// controllers/tagtypes.go
 		// controllers/thread.go
+		// controllers/threadsearch.go
 
-		key := redis.NewKey(request[0])
-		if key == nil {
+		// Get the tag for the namespace and the route's schema version
+		tag := schemaTag(config.Namespace, request[0])
+
+		// Set the full key with all path parameters, the query and the schema tag
+		// Example: For "/index/1/2?posts=5", key becomes "index:1" with field "2?posts=5"
+		// and with a schema version the field becomes "2?posts=5#v2"
+		key, ok := newCacheKey(request, query, tag)
+		if !ok {
 			// If the key type isn't recognized, bypass caching
+			setDiagnostics(c, config, cacheBypass, CacheKey{}, nil)
 			c.Next()
 			return
 		}
 
-		// Set the full key with all path parameters
-		// Example: For "/index/1/2", key becomes "index" with field "1:2"
-		key = key.SetKey(request[1:]...)
-
 		// Generate a unique singleflight key for request deduplication
 		// This identifies identical requests that should share the same database query
-		sfKey := strings.Join(append([]string{request[0]}, request[1:]...), ":")
+		sfKey := strings.Join(request, ":")
+		if query != "" {
+			sfKey += "?" + query
+		}
+
+		target := &cacheTarget{
+			route:  request[0],
+			key:    key,
+			sfKey:  sfKey,
+			schema: tag,
+		}
+
+		// -------------------------------------------------------------------------
+		// STEP 0: Check the in-process memory cache before going to Redis
+		// -------------------------------------------------------------------------
+		entry, memoryHit := InMemoryCache.Get(sfKey)
+
+		// Tell the analytics middleware whether the memory tier served the request,
+		// along with the memory cache counters also shown on the internal endpoint
+		hits, misses := InMemoryCache.Stats()
+		c.Set("memoryCached", memoryHit)
+		c.Set("memoryCacheHits", hits)
+		c.Set("memoryCacheMisses", misses)
+
+		if memoryHit {
+			serveEntry(c, target, entry, config)
+			return
+		}
 
 		// Get the current circuit state and whether the breaker allows this request
 		circuitState := CircuitBreaker.State()
@@ -103,6 +193,7 @@ func Cache() gin.HandlerFunc {
 		// This properly respects both open state and the limited request count in half-open state
 		if !allowRequest {
 			c.Set("circuitBreakerActive", true)
+			setDiagnostics(c, config, cacheBreaker, key, nil)
 			c.Next()
 			return
 		}
@@ -114,12 +205,17 @@ func Cache() gin.HandlerFunc {
 		}
 
 		// -------------------------------------------------------------------------
-		// STEP 1: Check if the response is already in Redis cache
+		// STEP 1: Check if the response is already in the cache store
 		// -------------------------------------------------------------------------
-		result, err := key.Get()
+		start := time.Now()
+		result, err := Store.Get(key)
+		elapsed := time.Since(start)
+
+		// The last entry stored for the target, served if the database is down
+		var fallback *cacheEntry
 
 		// Handle case where the key couldn't be constructed properly
-		if err == redis.ErrKeyNotSet {
+		if err == ErrKeyNotSet {
 			c.JSON(e.ErrorMessage(e.ErrInvalidParam))
 			c.Error(err).SetMeta("Cache.KeyNotSet")
 			c.Abort()
@@ -128,17 +224,33 @@ func Cache() gin.HandlerFunc {
 
 		// CACHE HIT: If the result is in cache, serve it and stop processing
 		if err == nil {
-			// Record success with circuit breaker
-			CircuitBreaker.RecordSuccess()
+			// Record success with circuit breaker, slow calls may count against it
+			CircuitBreaker.RecordDuration(elapsed)
 
-			c.Set("cached", true)
-			c.Data(http.StatusOK, "application/json", result)
-			c.Abort()
-			return
+			entry := decodeEntry(result)
+
+			// An expired negative entry or one written under another schema is a miss,
+			// the fill overwrites it in place
+			if target.current(entry) {
+				// Keep the entry in memory so the next hits skip Redis
+				InMemoryCache.Set(target.route, target.sfKey, entry)
+
+				serveEntry(c, target, entry, config)
+				return
+			}
+
+			if entry.Schema == target.schema {
+				fallback = entry
+			}
+		}
+
+		// A miss is still a working Redis for the failure rate
+		if err == ErrCacheMiss {
+			CircuitBreaker.RecordMiss(elapsed)
 		}
 
 		// Log any unexpected Redis errors and record failure with circuit breaker
-		if err != redis.ErrCacheMiss {
+		if err != nil && err != ErrCacheMiss {
 			c.Error(err).SetMeta("Cache.Redis.Get")
 
 			// Record Redis failure with circuit breaker
@@ -149,77 +261,62 @@ func Cache() gin.HandlerFunc {
 		// STEP 2: Handle cache miss with singleflight pattern
 		// -------------------------------------------------------------------------
 
-		// Tell the controller this is a cache miss so it knows to use the callback
-		c.Set("cacheMiss", true)
+		// Snapshot what the controller needs, the fill runs detached from this client
+		// so a disconnect or a slow client cannot fail the other waiting requests
+		handler := c.Handler()
+		snapshot := c.Copy()
 
-		// Set a timeout to avoid hanging indefinitely on failed requests
-		// In production use 10 seconds, but for tests check for a test timeout
-		requestTimeout := 10 * time.Second
-		// Allow tests to override the timeout for faster test execution
-		if testTimeout, exists := c.Get("testTimeout"); exists {
-			requestTimeout = testTimeout.(time.Duration)
-		}
+		// Only the request that runs the fill changes this, everyone else shared it
+		outcome := cacheShared
 
 		// Use singleflight to deduplicate concurrent requests for the same resource
 		// This ensures only ONE database query is made regardless of concurrent request count
 		data, err, shared := Group.Do(sfKey, func() (any, error) {
-			// Create channels for the controller to communicate its results back to us
-			resultChan := make(chan []byte, 1)
-			errorChan := make(chan error, 1)
-
-			// Set a callback that the controller will use to pass data back to the middleware
-			// The controller calls this with the JSON data after querying the database
-			c.Set("setDataCallback", func(data []byte, controllerErr error) {
-				if controllerErr != nil {
-					errorChan <- controllerErr
-					return
-				}
+			// Another instance may already be filling this key, in which case
+			// wait for its entry instead of running the same query again
+			lease, filled := leaseFill(target, config)
+			if filled != nil {
+				c.Set("cacheLeaseWait", true)
+				InMemoryCache.Set(target.route, target.sfKey, filled)
+				return filled, nil
+			}
+			defer lease.release()
 
-				// Validate that the controller returned proper JSON before caching it
-				if !json.Valid(data) {
-					errorChan <- errors.New("invalid JSON from controller")
-					return
-				}
+			outcome = cacheMissed
 
-				// Only attempt to cache if circuit breaker still allows it
-				// This ensures we respect the circuit breaker's decision on using Redis
-				if CircuitBreaker.AllowRequest() {
-					// Store the result in Redis cache for future requests
-					if err := key.Set(data); err != nil {
-						// If caching fails, we can still return the data to the client
-						// but we log the error for monitoring and record the failure
-						c.Error(err).SetMeta("Cache.Redis.Set")
-						CircuitBreaker.RecordFailure()
-					} else {
-						// Record successful cache operation which will close the circuit
-						// if we're in half-open state
-						CircuitBreaker.RecordSuccess()
-					}
-				}
+			// Execute the controller against a recorder with its own deadline
+			// This will trigger the database query in the controller
+			entry, errs, err := fillEntry(handler, snapshot, config.FillTimeout)
 
-				// Send the data back to the singleflight function
-				resultChan <- data
-			})
+			// Errors logged by the controller belong to the request that ran it
+			c.Errors = append(c.Errors, errs...)
 
-			// Execute the next middleware/controller in the chain
-			// This will trigger the database query in the controller
-			c.Next()
+			if err != nil {
+				return nil, err
+			}
 
-			// If the controller explicitly set an error flag, report it
-			if _, ok := c.Get("controllerError"); ok {
-				return nil, fmt.Errorf("controller returned an error")
+			// Not found responses are cached for a short time so requests for
+			// missing boards, threads and images do not all reach the database
+			if entry.status() == http.StatusNotFound && config.NotFoundTTL > 0 {
+				entry.Expires = entry.Stored.Add(config.NotFoundTTL)
 			}
 
-			// Wait for the controller to send data through our callback
-			// or timeout after the request timeout
-			select {
-			case data := <-resultChan:
-				return data, nil
-			case err := <-errorChan:
-				return nil, err
-			case <-time.After(requestTimeout):
-				return nil, fmt.Errorf("controller timed out after %v", requestTimeout)
+			// Other error responses are passed to every waiting client but never stored
+			if entry.cacheable() {
+				// Compress once here so cache hits never have to
+				if err := entry.compress(config.Encodings, config.CompressMinSize); err != nil {
+					c.Error(err).SetMeta("Cache.Compress")
+				}
+
+				// Store the result in Redis cache for future requests
+				if err := storeEntry(target, entry); err != nil {
+					// If caching fails, we can still return the data to the client
+					// but we log the error for monitoring
+					c.Error(err).SetMeta("Cache.Redis.Set")
+				}
 			}
+
+			return entry, nil
 		})
 
 		// Log whether this request was deduplicated by singleflight
@@ -227,21 +324,32 @@ func Cache() gin.HandlerFunc {
 			c.Set("sharedRequest", true)
 		}
 
-		// Handle any errors from the singleflight execution
-		if err != nil {
-			c.Error(err).SetMeta("Cache.SingleFlight")
-			// Avoid sending multiple responses if the controller already sent one
-			if c.Writer.Written() {
-				c.Abort()
+		setDiagnostics(c, config, outcome, key, nil)
+
+		// With the database down an expired entry beats no entry at all
+		if errors.Is(err, errDatabaseOpen) {
+			if fallback == nil {
+				databaseUnavailable(c)
 				return
 			}
+
+			markDegraded(c)
+			writeEntry(c, fallback)
+			c.Abort()
+			return
+		}
+
+		// Handle any errors from the singleflight execution, these are only
+		// timeouts and panics since controller errors come back as responses
+		if err != nil {
+			c.Error(err).SetMeta("Cache.SingleFlight")
 			c.JSON(e.ErrorMessage(e.ErrInternalError))
 			c.Abort()
 			return
 		}
 
-		// Get the JSON data returned by the singleflight function
-		jsonData, ok := data.([]byte)
+		// Get the entry returned by the singleflight function
+		entry, ok = data.(*cacheEntry)
 		if !ok {
 			c.Error(errors.New("invalid data type from singleflight")).SetMeta("Cache.InvalidData")
 			c.JSON(e.ErrorMessage(e.ErrInternalError))
@@ -249,13 +357,90 @@ func Cache() gin.HandlerFunc {
 			return
 		}
 
-		// Only write the response if the controller hasn't already done so
-		// This handles the case where the controller may have written directly to the client
-		if !c.Writer.Written() {
-			c.Data(http.StatusOK, "application/json", jsonData)
-		}
+		// Every client, including the one that ran the controller, gets the same response
+		writeEntry(c, entry)
 
 		// Stop further middleware execution
 		c.Abort()
 	}
 }
+
+// serveEntry writes a cached entry to the client, starting a background refresh
+// first if the entry is past its freshness window
+func serveEntry(c *gin.Context, target *cacheTarget, entry *cacheEntry, config CacheConfig) {
+	// STALE: serve what we have and rebuild the entry in the background
+	// so no client has to wait on the controller
+	if !entry.fresh(config.FreshFor) {
+		c.Set("cacheStale", true)
+
+		// The refresh cannot run while the database is down so this is all there is
+		if databaseDown() {
+			markDegraded(c)
+		}
+
+		refreshEntry(c, target, entry, config)
+	} else if entry.earlyRefresh(config.FreshFor, config.EarlyRefreshBeta) {
+		// EARLY: a fresh entry close to going stale may be rebuilt ahead of time,
+		// the refresh is deduplicated so only one request pays for it
+		c.Set("cacheEarlyRefresh", true)
+		refreshEntry(c, target, entry, config)
+	}
+
+	c.Set("cached", true)
+	setDiagnostics(c, config, cacheHit, target.key, entry)
+	writeEntry(c, entry)
+	c.Abort()
+}
+
+// writeEntry writes an entry with its validators, or a 304 Not Modified if the
+// client already holds this version of the response. Error responses are
+// replayed as is and flagged for the analytics middleware.
+func writeEntry(c *gin.Context, entry *cacheEntry) {
+	// Serve a stored encoding if the client takes it, otherwise decompress
+	encoding := entry.negotiate(c.GetHeader("Accept-Encoding"))
+
+	body, err := entry.bodyFor(encoding)
+	if err != nil {
+		c.Error(err).SetMeta("Cache.Decompress")
+		c.JSON(e.ErrorMessage(e.ErrInternalError))
+		return
+	}
+
+	if len(entry.Encodings) > 0 {
+		c.Header("Vary", "Accept-Encoding")
+	}
+
+	if entry.status() != http.StatusOK {
+		c.Set("controllerError", true)
+		writeBody(c, entry.status(), entry.contentType(), encoding, body)
+		return
+	}
+
+	setValidators(c, entry, encoding)
+
+	if entry.notModified(c.GetHeader("If-None-Match"), c.GetHeader("If-Modified-Since")) {
+		c.Status(http.StatusNotModified)
+		c.Writer.WriteHeaderNow()
+		return
+	}
+
+	writeBody(c, http.StatusOK, entry.contentType(), encoding, body)
+}
+
+// writeBody writes a response body in a content coding
+func writeBody(c *gin.Context, status int, contentType, encoding string, body []byte) {
+	if encoding != "" {
+		c.Header("Content-Encoding", encoding)
+	}
+
+	c.Data(status, contentType, body)
+}
+
+// setValidators sets the ETag and Last-Modified headers for an entry
+func setValidators(c *gin.Context, entry *cacheEntry, encoding string) {
+	c.Header("ETag", entry.etag(encoding))
+
+	if !entry.Modified.IsZero() {
+		c.Header("Last-Modified", entry.Modified.UTC().Format(http.TimeFormat))
+	}
+}
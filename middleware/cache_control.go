@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CachePolicy is the HTTP caching policy for a route
+type CachePolicy struct {
+	// MaxAge is how long browsers and CDNs may reuse a response
+	MaxAge time.Duration
+	// StaleWhileRevalidate is how long a stale response may be served while revalidating
+	StaleWhileRevalidate time.Duration
+	// Private keeps user specific responses out of shared caches
+	Private bool
+	// NoStore stops the response being cached at all
+	NoStore bool
+}
+
+// String renders the policy as a Cache-Control header value
+func (p CachePolicy) String() string {
+	if p.NoStore {
+		return "no-store"
+	}
+
+	directives := []string{"public"}
+
+	if p.Private {
+		directives[0] = "private"
+	}
+
+	directives = append(directives, fmt.Sprintf("max-age=%d", int(p.MaxAge.Seconds())))
+
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", int(p.StaleWhileRevalidate.Seconds())))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// CachePolicies holds the policy for each route, keyed by the first path segment.
+// Routes without a policy get no Cache-Control header.
+var CachePolicies = map[string]CachePolicy{
+	"index":        {MaxAge: 10 * time.Second, StaleWhileRevalidate: 30 * time.Second},
+	"thread":       {MaxAge: 10 * time.Second, StaleWhileRevalidate: 30 * time.Second},
+	"tag":          {MaxAge: 30 * time.Second, StaleWhileRevalidate: 60 * time.Second},
+	"image":        {MaxAge: 60 * time.Second, StaleWhileRevalidate: 5 * time.Minute},
+	"post":         {MaxAge: 60 * time.Second, StaleWhileRevalidate: 5 * time.Minute},
+	"tags":         {MaxAge: 60 * time.Second, StaleWhileRevalidate: 5 * time.Minute},
+	"tagsearch":    {MaxAge: 60 * time.Second, StaleWhileRevalidate: 5 * time.Minute},
+	"threadsearch": {MaxAge: 30 * time.Second, StaleWhileRevalidate: 60 * time.Second},
+	"directory":    {MaxAge: 30 * time.Second, StaleWhileRevalidate: 60 * time.Second},
+	"popular":      {MaxAge: 5 * time.Minute, StaleWhileRevalidate: 10 * time.Minute},
+	"new":          {MaxAge: 60 * time.Second, StaleWhileRevalidate: 5 * time.Minute},
+	"favorited":    {MaxAge: 5 * time.Minute, StaleWhileRevalidate: 10 * time.Minute},
+	"tagtypes":     {MaxAge: time.Hour, StaleWhileRevalidate: 24 * time.Hour},
+	"imageboards":  {MaxAge: 5 * time.Minute, StaleWhileRevalidate: time.Hour},
+	"views":        {MaxAge: 60 * time.Second, StaleWhileRevalidate: 5 * time.Minute},
+	"random":       {NoStore: true},
+	"whoami":       {Private: true},
+	"user":         {Private: true},
+	"stats":        {Private: true},
+}
+
+// CacheControl is a middleware that sets the Cache-Control header from the route's
+// policy once the response status is known. Only successful and not modified
+// responses get the policy, anything else is marked no-store so errors are not cached.
+func CacheControl() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Get the route name from the first path segment
+		route := strings.SplitN(strings.Trim(c.Request.URL.Path, "/"), "/", 2)[0]
+
+		policy, ok := CachePolicies[route]
+		if !ok {
+			c.Next()
+			return
+		}
+
+		c.Writer = &policyWriter{
+			ResponseWriter: c.Writer,
+			policy:         policy,
+		}
+
+		c.Next()
+	}
+}
+
+// policyWriter sets the Cache-Control header right before the headers are written
+type policyWriter struct {
+	gin.ResponseWriter
+	policy  CachePolicy
+	applied bool
+}
+
+// apply sets the header for the final status if it has not been written yet
+func (w *policyWriter) apply() {
+	if w.applied || w.Written() {
+		return
+	}
+
+	w.applied = true
+
+	switch w.Status() {
+	case http.StatusOK, http.StatusNotModified:
+		w.Header().Set("Cache-Control", w.policy.String())
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+	}
+}
+
+// WriteHeaderNow writes the headers with the cache policy
+func (w *policyWriter) WriteHeaderNow() {
+	w.apply()
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+// Write writes the body with the cache policy
+func (w *policyWriter) Write(data []byte) (int, error) {
+	w.apply()
+	return w.ResponseWriter.Write(data)
+}
+
+// WriteString writes the body with the cache policy
+func (w *policyWriter) WriteString(s string) (int, error) {
+	w.apply()
+	return w.ResponseWriter.WriteString(s)
+}
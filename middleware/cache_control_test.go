@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCachePolicyString(t *testing.T) {
+
+	public := CachePolicy{MaxAge: 10 * time.Second, StaleWhileRevalidate: 30 * time.Second}
+	assert.Equal(t, "public, max-age=10, stale-while-revalidate=30", public.String(), "Policy should match")
+
+	private := CachePolicy{Private: true}
+	assert.Equal(t, "private, max-age=0", private.String(), "Policy should match")
+
+	nostore := CachePolicy{NoStore: true, MaxAge: time.Hour}
+	assert.Equal(t, "no-store", nostore.String(), "Policy should match")
+}
+
+func TestCacheControl(t *testing.T) {
+
+	gin.SetMode(gin.ReleaseMode)
+
+	router := gin.New()
+
+	router.Use(CacheControl())
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	router.GET("/thread/:ib/:thread/:page", func(c *gin.Context) {
+		c.String(500, "BAD!!")
+	})
+
+	router.GET("/image/:ib/:id", func(c *gin.Context) {
+		c.Status(304)
+		c.Writer.WriteHeaderNow()
+	})
+
+	router.GET("/user/favorites/:ib/:page", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	router.GET("/status", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	index := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, index.Code, "HTTP request code should match")
+	assert.Equal(t, CachePolicies["index"].String(), index.Header().Get("Cache-Control"), "Header should match")
+
+	thread := performRequest(router, "GET", "/thread/1/1/1")
+	assert.Equal(t, 500, thread.Code, "HTTP request code should match")
+	assert.Equal(t, "no-store", thread.Header().Get("Cache-Control"), "Errors should not be cached")
+
+	image := performRequest(router, "GET", "/image/1/1")
+	assert.Equal(t, 304, image.Code, "HTTP request code should match")
+	assert.Equal(t, CachePolicies["image"].String(), image.Header().Get("Cache-Control"), "Header should match")
+
+	user := performRequest(router, "GET", "/user/favorites/1/1")
+	assert.Equal(t, "private, max-age=0", user.Header().Get("Cache-Control"), "Header should match")
+
+	status := performRequest(router, "GET", "/status")
+	assert.Empty(t, status.Header().Get("Cache-Control"), "Routes without a policy should not get a header")
+}
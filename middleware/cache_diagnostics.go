@@ -0,0 +1,45 @@
+package middleware
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Values of the X-Cache diagnostic header
+const (
+	// cacheHit is a response served from the memory cache or Redis
+	cacheHit = "HIT"
+	// cacheMissed is a response this request built by running the controller
+	cacheMissed = "MISS"
+	// cacheShared is a response built by another request, on this instance or another
+	cacheShared = "SHARED"
+	// cacheBypass is a request the cache does not handle
+	cacheBypass = "BYPASS"
+	// cacheBreaker is a request sent straight to the controller by the open circuit breaker
+	cacheBreaker = "BREAKER"
+)
+
+// setDiagnostics sets the X-Cache headers describing how the cache handled a request.
+// X-Cache-Key and X-Cache-Field name the entry in the store the way redis-cli takes
+// them, and X-Cache-Age is how many seconds ago the entry was stored
+func setDiagnostics(c *gin.Context, config CacheConfig, result string, key CacheKey, entry *cacheEntry) {
+	if !config.Diagnostics {
+		return
+	}
+
+	c.Header("X-Cache", result)
+
+	if key.Key != "" {
+		c.Header("X-Cache-Key", key.Key)
+	}
+
+	if key.Field != "" {
+		c.Header("X-Cache-Field", key.Field)
+	}
+
+	if entry != nil && !entry.Stored.IsZero() {
+		c.Header("X-Cache-Age", strconv.Itoa(int(time.Since(entry.Stored).Seconds())))
+	}
+}
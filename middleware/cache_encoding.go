@@ -0,0 +1,165 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings the cache can store entries in
+const (
+	encodingBrotli = "br"
+	encodingGzip   = "gzip"
+)
+
+// encoders compress a body into a content coding
+var encoders = map[string]func([]byte) ([]byte, error){
+	encodingBrotli: func(body []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+	encodingGzip: func(body []byte) ([]byte, error) {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	},
+}
+
+// decoders return a reader for the decompressed body of a content coding
+var decoders = map[string]func(io.Reader) (io.Reader, error){
+	encodingBrotli: func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+	encodingGzip: func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+}
+
+// compress adds the given encodings of the body to the entry. Bodies smaller than
+// minSize are left alone since compressing them saves nothing. Once an entry has
+// encodings only those are stored in Redis and the identity body is dropped.
+func (entry *cacheEntry) compress(encodings []string, minSize int) error {
+	if len(entry.Body) < minSize {
+		return nil
+	}
+
+	for _, encoding := range encodings {
+		encoder, ok := encoders[encoding]
+		if !ok {
+			return fmt.Errorf("unknown cache encoding %q", encoding)
+		}
+
+		encoded, err := encoder(entry.Body)
+		if err != nil {
+			return err
+		}
+
+		if entry.Encoded == nil {
+			entry.Encoded = make(map[string][]byte)
+		}
+
+		entry.Encoded[encoding] = encoded
+		entry.Encodings = append(entry.Encodings, encoding)
+	}
+
+	return nil
+}
+
+// negotiate returns the stored encoding to serve for an Accept-Encoding header, in
+// the order the entry was compressed in, or empty to serve the identity body
+func (entry *cacheEntry) negotiate(acceptEncoding string) string {
+	for _, encoding := range entry.Encodings {
+		if acceptsEncoding(acceptEncoding, encoding) {
+			return encoding
+		}
+	}
+
+	return ""
+}
+
+// bodyFor returns the body in an encoding, decompressing a stored encoding for
+// clients that only take the identity body
+func (entry *cacheEntry) bodyFor(encoding string) ([]byte, error) {
+	if encoding != "" {
+		return entry.Encoded[encoding], nil
+	}
+
+	if entry.Body != nil || len(entry.Encodings) == 0 {
+		return entry.Body, nil
+	}
+
+	stored := entry.Encodings[0]
+
+	r, err := decoders[stored](bytes.NewReader(entry.Encoded[stored]))
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+// size returns the number of body bytes the entry holds in all its encodings
+func (entry *cacheEntry) size() int {
+	size := len(entry.Body)
+
+	for _, encoded := range entry.Encoded {
+		size += len(encoded)
+	}
+
+	return size
+}
+
+// etag returns the ETag of the entry in an encoding. Each encoding is a different
+// representation so it gets its own strong validator.
+func (entry *cacheEntry) etag(encoding string) string {
+	if encoding == "" || entry.ETag == "" {
+		return entry.ETag
+	}
+
+	return strings.TrimSuffix(entry.ETag, `"`) + "-" + encoding + `"`
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows a content coding
+func acceptsEncoding(acceptEncoding, encoding string) bool {
+	wildcard := false
+
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		// A zero quality value means the coding is not acceptable
+		accepted := true
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				accepted = false
+			}
+		}
+
+		switch name {
+		case encoding:
+			return accepted
+		case "*":
+			wildcard = accepted
+		}
+	}
+
+	return wildcard
+}
@@ -0,0 +1,140 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, test := range []struct {
+		header   string
+		encoding string
+		accepted bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "br", true},
+		{"GZIP", "gzip", true},
+		{"deflate", "gzip", false},
+		{"gzip;q=0", "gzip", false},
+		{"gzip;q=0.5, br;q=1.0", "gzip", true},
+		{"*", "br", true},
+		{"*;q=0", "br", false},
+		{"br;q=0, *", "br", false},
+		{"identity", "gzip", false},
+	} {
+		assert.Equal(t, test.accepted, acceptsEncoding(test.header, test.encoding), "Acceptance should match for %q", test.header)
+	}
+}
+
+func TestCacheEntryCompression(t *testing.T) {
+	body := []byte(`{"thread":"` + strings.Repeat("post ", 500) + `"}`)
+
+	entry := newCacheEntry(body)
+
+	assert.NoError(t, entry.compress([]string{encodingBrotli, encodingGzip}, 1024), "An error was not expected")
+	assert.Equal(t, []string{encodingBrotli, encodingGzip}, entry.Encodings, "Encodings should match")
+	assert.Less(t, len(entry.Encoded[encodingGzip]), len(body), "Body should be compressed")
+
+	// only the encodings are stored
+	raw, err := encodeEntry(entry)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Less(t, len(raw), len(body), "Stored entry should be smaller than the body")
+
+	decoded := decodeEntry(raw)
+	assert.False(t, decoded.legacy, "Entry should not be legacy")
+	assert.Nil(t, decoded.Body, "Identity body should not be stored")
+	assert.Equal(t, entry.ETag, decoded.ETag, "ETag should match")
+	assert.Equal(t, entry.Encoded, decoded.Encoded, "Encodings should match")
+
+	// identity clients get the body decompressed
+	identity, err := decoded.bodyFor("")
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, body, identity, "Body should match")
+
+	assert.Equal(t, encodingGzip, decoded.negotiate("gzip, deflate"), "Encoding should match")
+	assert.Equal(t, encodingBrotli, decoded.negotiate("gzip, br"), "Encoding should match")
+	assert.Empty(t, decoded.negotiate("deflate"), "Encoding should be identity")
+
+	// each encoding has its own validator but they all match
+	assert.NotEqual(t, decoded.ETag, decoded.etag(encodingGzip), "ETag should differ")
+	assert.True(t, decoded.notModified(decoded.etag(encodingGzip), ""), "Encoded tag should match")
+	assert.True(t, decoded.notModified(decoded.ETag, ""), "Identity tag should match")
+
+	// small bodies are left alone
+	small := newCacheEntry([]byte(`{"small":true}`))
+	assert.NoError(t, small.compress([]string{encodingGzip}, 1024), "An error was not expected")
+	assert.Empty(t, small.Encodings, "Small body should not be compressed")
+
+	assert.Error(t, entry.compress([]string{"lzma"}, 0), "An error was expected")
+
+	// sizes that do not add up make the entry unreadable as an envelope
+	entry.Encoded[encodingGzip] = entry.Encoded[encodingGzip][:10]
+	short, err := encodeEntry(entry)
+	assert.NoError(t, err, "An error was not expected")
+	assert.True(t, decodeEntry(short[:len(short)-5]).legacy, "Entry should be legacy")
+}
+
+func TestCacheCompressed(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	body := []byte(`{"thread":"` + strings.Repeat("post ", 500) + `"}`)
+
+	router := gin.New()
+	router.Use(Cache())
+
+	router.GET("/thread/:ib/:thread/:page", func(c *gin.Context) {
+		c.Data(200, "application/json", body)
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	brotliResponse := performRequestWithHeaders(router, "GET", "/thread/1/1/1", map[string]string{
+		"Accept-Encoding": "gzip, deflate, br",
+	})
+	assert.Equal(t, 200, brotliResponse.Code, "HTTP request code should match")
+	assert.Equal(t, "br", brotliResponse.Header().Get("Content-Encoding"), "Encoding should match")
+	assert.Equal(t, "Accept-Encoding", brotliResponse.Header().Get("Vary"), "Vary should match")
+
+	decompressed, err := io.ReadAll(brotli.NewReader(brotliResponse.Body))
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, body, decompressed, "Body should match")
+
+	// the next requests are served from the memory cache
+	gzipResponse := performRequestWithHeaders(router, "GET", "/thread/1/1/1", map[string]string{
+		"Accept-Encoding": "gzip",
+	})
+	assert.Equal(t, "gzip", gzipResponse.Header().Get("Content-Encoding"), "Encoding should match")
+
+	reader, err := gzip.NewReader(gzipResponse.Body)
+	assert.NoError(t, err, "An error was not expected")
+	decompressed, err = io.ReadAll(reader)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, body, decompressed, "Body should match")
+
+	// compressed entries from the store are decompressed for clients without gzip or brotli
+	entry := newCacheEntry(body)
+	assert.NoError(t, entry.compress([]string{encodingGzip}, 0), "An error was not expected")
+	raw, err := encodeEntry(entry)
+	assert.NoError(t, err, "An error was not expected")
+
+	store.Set(CacheKey{Key: "thread:1:2", Field: "1"}, raw, 0)
+
+	identity := performRequest(router, "GET", "/thread/1/2/1")
+	assert.Equal(t, 200, identity.Code, "HTTP request code should match")
+	assert.Empty(t, identity.Header().Get("Content-Encoding"), "Encoding should be identity")
+	assert.True(t, bytes.Equal(body, identity.Body.Bytes()), "Body should match")
+	assert.Equal(t, entry.ETag, identity.Header().Get("ETag"), "ETag should match")
+}
@@ -0,0 +1,298 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// entryMagic prefixes every cache entry written by this version of the middleware.
+// Entries without it were written by older versions which stored the raw JSON body.
+var entryMagic = []byte("EGC1")
+
+// cacheEntry is a cached response plus the metadata needed to decide how to serve it.
+//
+// Entries are stored in Redis as the magic prefix, a 4 byte big endian header length,
+// the JSON encoded header, and then the response body. Compressed entries store each
+// encoding of the body one after another instead, sized by the header.
+type cacheEntry struct {
+	// Stored is when the entry was written to the cache
+	Stored time.Time `json:"stored"`
+	// ETag is the strong validator for the body, computed once when the entry is created
+	ETag string `json:"etag"`
+	// Modified is when the body last changed, a refresh that builds the same body
+	// keeps the time of the entry it replaces
+	Modified time.Time `json:"modified,omitzero"`
+	// Status is the response status, zero means 200 OK
+	Status int `json:"status,omitempty"`
+	// Type is the response content type, empty means JSON
+	Type string `json:"type,omitempty"`
+	// Expires is when a negative entry stops being served, zero for normal entries
+	Expires time.Time `json:"expires,omitzero"`
+	// Delta is how long the controller took to build the entry
+	Delta time.Duration `json:"delta,omitempty"`
+	// Schema is the namespace and schema version tag the entry was written under
+	Schema string `json:"schema,omitempty"`
+	// Encodings lists the content codings the body is stored in, in order of preference
+	Encodings []string `json:"encodings,omitempty"`
+	// Sizes holds the length of each stored encoding, it is only set in Redis
+	Sizes []int `json:"sizes,omitempty"`
+	// Body is the response body, it is not part of the header and is nil for
+	// compressed entries read back from Redis
+	Body []byte `json:"-"`
+	// Encoded holds the compressed bodies keyed by content coding
+	Encoded map[string][]byte `json:"-"`
+	// legacy is set for entries written before metadata was stored
+	legacy bool
+}
+
+// newCacheEntry wraps a response body with fresh metadata
+func newCacheEntry(body []byte) *cacheEntry {
+	now := time.Now()
+
+	return &cacheEntry{
+		Stored:   now,
+		ETag:     computeETag(body),
+		Modified: now,
+		Body:     body,
+	}
+}
+
+// status returns the response status of the entry
+func (entry *cacheEntry) status() int {
+	if entry.Status == 0 {
+		return http.StatusOK
+	}
+
+	return entry.Status
+}
+
+// contentType returns the response content type of the entry
+func (entry *cacheEntry) contentType() string {
+	if entry.Type == "" {
+		return "application/json"
+	}
+
+	return entry.Type
+}
+
+// cacheable reports whether the entry is a JSON response that may be stored, which is
+// a successful response or a not found response that has been given an expiry
+func (entry *cacheEntry) cacheable() bool {
+	switch entry.status() {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		if entry.Expires.IsZero() {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return json.Valid(entry.Body)
+}
+
+// expired reports whether a negative entry is past its expiry and has to be
+// treated as a cache miss, normal entries never expire
+func (entry *cacheEntry) expired() bool {
+	return !entry.Expires.IsZero() && !time.Now().Before(entry.Expires)
+}
+
+// computeETag returns a strong ETag for a response body
+func computeETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return fmt.Sprintf(`"%x"`, sum[:16])
+}
+
+// encodeEntry serializes an entry for storage in Redis
+func encodeEntry(entry *cacheEntry) ([]byte, error) {
+	// Entries are shared between requests so the sizes go on a copy
+	meta := *entry
+	parts := [][]byte{entry.Body}
+
+	if len(entry.Encodings) > 0 {
+		parts = nil
+		meta.Sizes = nil
+
+		for _, encoding := range entry.Encodings {
+			parts = append(parts, entry.Encoded[encoding])
+			meta.Sizes = append(meta.Sizes, len(entry.Encoded[encoding]))
+		}
+	}
+
+	header, err := json.Marshal(&meta)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 0, len(entryMagic)+4+len(header)+entry.size())
+	buf = append(buf, entryMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(header)))
+	buf = append(buf, header...)
+
+	for _, part := range parts {
+		buf = append(buf, part...)
+	}
+
+	return buf, nil
+}
+
+// decodeEntry parses an entry read from Redis. Anything that is not a valid
+// envelope is treated as a legacy entry holding only the response body.
+func decodeEntry(data []byte) *cacheEntry {
+	if !bytes.HasPrefix(data, entryMagic) || len(data) < len(entryMagic)+4 {
+		return legacyEntry(data)
+	}
+
+	rest := data[len(entryMagic):]
+	size := binary.BigEndian.Uint32(rest)
+	rest = rest[4:]
+
+	if uint64(size) > uint64(len(rest)) {
+		return legacyEntry(data)
+	}
+
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(rest[:size], entry); err != nil {
+		return legacyEntry(data)
+	}
+
+	entry.Body = rest[size:]
+
+	// Split a compressed body into its encodings
+	if len(entry.Encodings) > 0 {
+		if !entry.splitEncodings() {
+			return legacyEntry(data)
+		}
+	}
+
+	// Entries written before ETags were stored get one now
+	if entry.ETag == "" && entry.Body != nil {
+		entry.ETag = computeETag(entry.Body)
+	}
+
+	return entry
+}
+
+// splitEncodings moves the stored encodings out of the body using their sizes
+func (entry *cacheEntry) splitEncodings() bool {
+	if len(entry.Sizes) != len(entry.Encodings) {
+		return false
+	}
+
+	body := entry.Body
+	entry.Body = nil
+	entry.Encoded = make(map[string][]byte, len(entry.Encodings))
+
+	for i, encoding := range entry.Encodings {
+		if _, ok := decoders[encoding]; !ok || entry.Sizes[i] < 0 || entry.Sizes[i] > len(body) {
+			return false
+		}
+
+		entry.Encoded[encoding] = body[:entry.Sizes[i]]
+		body = body[entry.Sizes[i]:]
+	}
+
+	entry.Sizes = nil
+
+	return len(body) == 0
+}
+
+// legacyEntry wraps a raw body written by an older version of the middleware
+func legacyEntry(data []byte) *cacheEntry {
+	return &cacheEntry{
+		ETag:   computeETag(data),
+		Body:   data,
+		legacy: true,
+	}
+}
+
+// fresh reports whether the entry may be served without a refresh. Legacy entries
+// carry no timestamp and stay fresh until they are invalidated, as they always have.
+func (entry *cacheEntry) fresh(window time.Duration) bool {
+	if entry.legacy || window <= 0 {
+		return true
+	}
+
+	return time.Since(entry.Stored) < window
+}
+
+// earlyRefresh reports whether the entry should be refreshed before its freshness
+// window ends, following the XFetch algorithm. The chance grows as the window runs
+// out and with how long the last fill took, so slow keys are rebuilt ahead of time
+// while cheap keys are only rebuilt right at the end. A zero beta disables it.
+func (entry *cacheEntry) earlyRefresh(window time.Duration, beta float64) bool {
+	if entry.legacy || window <= 0 || beta <= 0 || entry.Delta <= 0 {
+		return false
+	}
+
+	// -log(rand) is exponentially distributed, 1-rand keeps it away from log(0)
+	gap := time.Duration(float64(entry.Delta) * beta * -math.Log(1-rand.Float64()))
+
+	return time.Since(entry.Stored)+gap >= window
+}
+
+// keepModified carries the modified time over from the entry being replaced when
+// the body has not changed, so refreshes alone do not move Last-Modified
+func (entry *cacheEntry) keepModified(previous *cacheEntry) {
+	if previous == nil || previous.ETag == "" || previous.ETag != entry.ETag || previous.Modified.IsZero() {
+		return
+	}
+
+	entry.Modified = previous.Modified
+}
+
+// notModified reports whether the client already holds this version of the entry.
+// If-None-Match takes precedence and If-Modified-Since is only used without it.
+func (entry *cacheEntry) notModified(ifNoneMatch, ifModifiedSince string) bool {
+	if ifNoneMatch != "" {
+		return entry.matchETag(ifNoneMatch)
+	}
+
+	if ifModifiedSince == "" || entry.Modified.IsZero() {
+		return false
+	}
+
+	since, err := http.ParseTime(ifModifiedSince)
+	if err != nil {
+		return false
+	}
+
+	// HTTP dates only have second precision
+	return !entry.Modified.Truncate(time.Second).After(since)
+}
+
+// matchETag reports whether an If-None-Match header matches the entry. The
+// header may hold a list of tags or a wildcard, and uses the weak comparison.
+// A tag for any stored encoding matches since they all hold the same data.
+func (entry *cacheEntry) matchETag(ifNoneMatch string) bool {
+	if entry.ETag == "" {
+		return false
+	}
+
+	for _, tag := range strings.Split(ifNoneMatch, ",") {
+		tag = strings.TrimSpace(tag)
+
+		if tag == "*" {
+			return true
+		}
+
+		tag = strings.TrimPrefix(tag, "W/")
+
+		if tag == entry.ETag || slices.ContainsFunc(entry.Encodings, func(encoding string) bool {
+			return tag == entry.etag(encoding)
+		}) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,117 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// leasePollInterval is how often a waiting instance checks Redis for the entry
+const leasePollInterval = 50 * time.Millisecond
+
+// releaseScript deletes a lease only if it still holds our token, so a fill that
+// outlived its lease cannot release the lease another instance has since taken
+const releaseScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// fillLease is a Redis lease held by this instance while it fills a cache entry,
+// it extends singleflight across every instance sharing the Redis cache
+type fillLease struct {
+	key   string
+	token string
+}
+
+// leaseEnabled reports whether fills should take a lease, which needs Redis
+func leaseEnabled(config CacheConfig) bool {
+	return config.LeaseTTL > 0 && storeShared() && CircuitBreaker.State() != StateOpen
+}
+
+// acquireLease tries to take the fill lease for a target. It returns a nil lease
+// without an error if another instance already holds it.
+func acquireLease(target *cacheTarget, ttl time.Duration) (*fillLease, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	lease := &fillLease{
+		key:   "lease:" + target.sfKey + tagSuffix(target.schema),
+		token: hex.EncodeToString(token),
+	}
+
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	reply, err := conn.Do("SET", lease.key, lease.token, "NX", "PX", ttl.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+
+	// SET NX replies with nil when the key already exists
+	if reply == nil {
+		return nil, nil
+	}
+
+	return lease, nil
+}
+
+// release gives the lease up once the entry is stored, a nil lease does nothing
+func (lease *fillLease) release() {
+	if lease == nil {
+		return
+	}
+
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	// The lease expires on its own if this fails
+	_, _ = conn.Do("EVAL", releaseScript, 1, lease.key, lease.token)
+}
+
+// leaseFill coordinates a cache fill with the other instances. It returns the lease
+// to release once the entry is stored, or the entry another instance stored while
+// this one waited for it. Both are nil when leases are disabled, Redis is failing,
+// or the wait ran out, and the caller then fills the entry without a lease.
+func leaseFill(target *cacheTarget, config CacheConfig) (*fillLease, *cacheEntry) {
+	if !leaseEnabled(config) {
+		return nil, nil
+	}
+
+	lease, err := acquireLease(target, config.LeaseTTL)
+	if err != nil {
+		CircuitBreaker.RecordFailure()
+		return nil, nil
+	}
+
+	if lease != nil {
+		return lease, nil
+	}
+
+	return nil, waitForFill(target, config.LeaseWait)
+}
+
+// waitForFill polls the store for the entry being filled by the instance holding the lease
+func waitForFill(target *cacheTarget, wait time.Duration) *cacheEntry {
+	deadline := time.Now().Add(wait)
+
+	for time.Now().Before(deadline) {
+		time.Sleep(leasePollInterval)
+
+		result, err := Store.Get(target.key)
+		if err == ErrCacheMiss {
+			continue
+		}
+
+		// Stop waiting on Redis errors, the caller will fill the entry itself
+		if err != nil {
+			return nil
+		}
+
+		if entry := decodeEntry(result); target.current(entry) {
+			return entry
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package middleware
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheFillLease(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	var calls atomic.Int32
+
+	config := DefaultCacheConfig
+	config.LeaseTTL = time.Second
+	config.LeaseWait = 300 * time.Millisecond
+
+	router := gin.New()
+	router.Use(CacheWithConfig(config))
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		calls.Add(1)
+		c.Data(200, "application/json", []byte(`{"index":"local"}`))
+	})
+
+	redis.NewRedisMock()
+
+	// another instance holds the lease for the second and third pages
+	redis.Cache.Mock.GenericCommand("SET").Handle(func(args []any) (any, error) {
+		if args[0] == "lease:index:1:1" {
+			return "OK", nil
+		}
+		return nil, nil
+	})
+	release := redis.Cache.Mock.GenericCommand("EVAL").Expect(int64(1))
+	redis.Cache.Mock.GenericCommand("HMSET").Expect("OK")
+	// there are no negative entries
+	redis.Cache.Mock.GenericCommand("GET").Expect(nil)
+
+	remote := newCacheEntry([]byte(`{"index":"remote"}`))
+	raw, err := encodeEntry(remote)
+	assert.NoError(t, err, "An error was not expected")
+
+	// the other instance stores the second page after the first poll
+	var polls atomic.Int32
+	redis.Cache.Mock.GenericCommand("HGET").Handle(func(args []any) (any, error) {
+		if args[1] == "2" && polls.Add(1) > 2 {
+			return raw, nil
+		}
+		return nil, nil
+	})
+
+	// with the lease this instance fills the entry and releases the lease
+	leader := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, leader.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"local"}`, leader.Body.String(), "Body should match")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should run")
+	assert.Equal(t, 1, redis.Cache.Mock.Stats(release), "Lease should be released")
+
+	// without it the entry from the other instance is served
+	follower := performRequest(router, "GET", "/index/1/2")
+	assert.Equal(t, 200, follower.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"remote"}`, follower.Body.String(), "Body should match")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should not run")
+
+	// if the other instance never stores the entry the controller runs after the wait
+	timeout := performRequest(router, "GET", "/index/1/3")
+	assert.Equal(t, 200, timeout.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"local"}`, timeout.Body.String(), "Body should match")
+	assert.Equal(t, int32(2), calls.Load(), "Controller should run")
+}
+
+func TestCacheFillLeaseBypass(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	InMemoryCache = NewMemoryCache()
+
+	config := DefaultCacheConfig
+
+	// leases are off by default
+	assert.False(t, leaseEnabled(config), "Lease should be disabled")
+
+	config.LeaseTTL = time.Second
+
+	CircuitBreaker = NewCircuitBreaker()
+	assert.True(t, leaseEnabled(config), "Lease should be enabled")
+
+	// an open circuit bypasses Redis so there is no lease either
+	CircuitBreaker = NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    1,
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+	})
+	CircuitBreaker.RecordFailure()
+	assert.False(t, leaseEnabled(config), "Lease should be disabled")
+
+	lease, filled := leaseFill(&cacheTarget{route: "index", sfKey: "index:1:1"}, config)
+	assert.Nil(t, lease, "Lease should be nil")
+	assert.Nil(t, filled, "Entry should be nil")
+
+	// a nil lease can always be released
+	lease.release()
+}
@@ -0,0 +1,272 @@
+package middleware
+
+import (
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/eirka/eirka-libs/validate"
+)
+
+// queryParam is a query parameter that a route may be cached with
+type queryParam struct {
+	// name is the query parameter name
+	name string
+	// normalize returns the canonical value the controller would use for a raw
+	// value, which is empty when the parameter is missing. Returning false means
+	// the request cannot be cached and goes straight to the controller.
+	normalize func(value string) (string, bool)
+}
+
+// cacheQueryParams holds the query parameters each route may be cached with,
+// keyed by the first path segment. They must mirror how the controllers read
+// and clamp the same parameters. Any other parameter bypasses the cache.
+var cacheQueryParams = map[string][]queryParam{
+	"index": {
+		{name: "posts", normalize: clampParam(func() uint { return config.Settings.Limits.PostsPerThread }, 10, 0)},
+		{name: "threads", normalize: clampParam(func() uint { return config.Settings.Limits.ThreadsPerPage }, 20, 5)},
+	},
+	"thread": {
+		{name: "posts", normalize: clampParam(func() uint { return config.Settings.Limits.PostsPerPage }, 100, 20)},
+	},
+	"tagsearch": {
+		{name: "search", normalize: searchParam(func() int { return config.Settings.Limits.TagMaxLength })},
+	},
+	"threadsearch": {
+		{name: "search", normalize: searchParam(func() int { return config.Settings.Limits.TitleMaxLength })},
+	},
+}
+
+// clampParam normalizes a numeric parameter the way the controllers do, falling
+// back to a default from the config and clamping the value to a range
+func clampParam(fallback func() uint, max, min uint) func(string) (string, bool) {
+	return func(value string) (string, bool) {
+		if value == "" {
+			value = strconv.FormatUint(uint64(fallback()), 10)
+		}
+
+		// the controller will reject anything that is not a uint
+		parsed, err := validate.ValidateParam(value)
+		if err != nil {
+			return "", false
+		}
+
+		return strconv.FormatUint(uint64(validate.Clamp(parsed, max, min)), 10), true
+	}
+}
+
+// searchParam checks a search term, terms that are missing or too long are errors
+// in the models so they are left to the controller. The term is kept exactly as sent
+// since the controller passes it to the model untrimmed.
+func searchParam(maxLength func() int) func(string) (string, bool) {
+	return func(value string) (string, bool) {
+		if value == "" || len(value) > maxLength() {
+			return "", false
+		}
+
+		return value, true
+	}
+}
+
+// cacheQuery returns the canonical query string a request is cached under. Parameters
+// at their default value are left out so they share the entry of the bare path.
+// It returns false if the query has anything the route does not allow.
+func cacheQuery(route string, values url.Values) (string, bool) {
+	params, ok := cacheQueryParams[route]
+	if !ok {
+		return "", len(values) == 0
+	}
+
+	// Unknown, repeated or empty parameters bypass the cache
+	for name, value := range values {
+		if len(value) != 1 || value[0] == "" || !slices.ContainsFunc(params, func(p queryParam) bool { return p.name == name }) {
+			return "", false
+		}
+	}
+
+	var parts []string
+
+	for _, param := range params {
+		value, ok := param.normalize(values.Get(param.name))
+		if !ok {
+			return "", false
+		}
+
+		// Skip values that match what the controller uses without the parameter
+		if fallback, ok := param.normalize(""); ok && fallback == value {
+			continue
+		}
+
+		parts = append(parts, param.name+"="+url.QueryEscape(value))
+	}
+
+	return strings.Join(parts, "&"), true
+}
+
+// cacheKeyer is the part of a Redis key the cache middleware uses
+type cacheKeyer interface {
+	Get() ([]byte, error)
+	Set(data []byte) error
+	String() string
+}
+
+// searchKeys holds the routes that have no key in eirka-libs, nothing invalidates
+// them so their hashes expire like the other unmanaged keys
+var searchKeys = map[string]uint{
+	"tagsearch":    600,
+	"threadsearch": 600,
+}
+
+// plainKeyExpiry holds how long the plain eirka-libs keys live, in seconds, which
+// the library does not expose. A tagged plain key is kept as a hash with the same
+// expiry. Plain keys missing here do not expire.
+var plainKeyExpiry = map[string]uint{
+	"new":         600,
+	"popular":     600,
+	"favorited":   600,
+	"imageboards": 600,
+}
+
+// newCacheKey returns the cache key for a request path, its canonical query and
+// schema tag, or false if the route is not cached. The key name is empty if the
+// path does not fit the route.
+func newCacheKey(request []string, query, tag string) (CacheKey, bool) {
+	if expire, ok := searchKeys[request[0]]; ok {
+		search := newSearchKey(request, query+tagSuffix(tag), expire)
+		return CacheKey{Key: search.key, Field: search.field, keyer: search}, true
+	}
+
+	key := redis.NewKey(request[0])
+	if key == nil {
+		return CacheKey{}, false
+	}
+
+	// The query and schema tag become part of the hash field so the entries are
+	// still removed when eirka-post or eirka-admin delete the key
+	suffix := ""
+	if query != "" {
+		suffix += "?" + query
+	}
+
+	if tag != "" && isHashKey(request) {
+		suffix += tagSuffix(tag)
+	}
+
+	ids := request[1:]
+	if suffix != "" && len(ids) > 0 {
+		ids = slices.Clone(ids)
+		ids[len(ids)-1] += suffix
+	}
+
+	lib := key.SetKey(ids...)
+
+	cacheKey := CacheKey{Key: lib.String(), keyer: lib}
+	if cacheKey.Key != "" && isHashKey(request) {
+		cacheKey.Field = ids[len(ids)-1]
+	}
+
+	// A tagged plain key becomes a hash under the same name with the tag as its
+	// field, so deployments and schema versions each keep their own entry and
+	// deleting the key still removes all of them
+	if cacheKey.Key != "" && cacheKey.Field == "" && tag != "" {
+		plain := &hashKey{key: cacheKey.Key, field: tagSuffix(tag), expire: plainKeyExpiry[request[0]], keyset: true}
+		return CacheKey{Key: plain.key, Field: plain.field, keyer: plain}, true
+	}
+
+	return cacheKey, true
+}
+
+// tagSuffix returns the hash field suffix for a schema tag
+func tagSuffix(tag string) string {
+	if tag == "" {
+		return ""
+	}
+
+	return schemaSeparator + tag
+}
+
+// isHashKey reports whether a request path maps to a hash field rather than a
+// plain key, in which case the last id is not part of the key name
+func isHashKey(request []string) bool {
+	key := redis.NewKey(request[0])
+	if key == nil {
+		return false
+	}
+
+	name := key.SetKey(request[1:]...).String()
+
+	return name != "" && name != strings.Join(request, ":")
+}
+
+// hashKey is a Redis hash the eirka-libs keys do not cover, such as the hash per
+// board holding search results keyed by the query
+type hashKey struct {
+	key    string
+	field  string
+	expire uint
+	keyset bool
+}
+
+// newSearchKey builds the key for a search route, which takes only the board
+func newSearchKey(request []string, query string, expire uint) *hashKey {
+	key := &hashKey{expire: expire}
+
+	if len(request) != 2 || query == "" {
+		return key
+	}
+
+	key.key = strings.Join(request, ":")
+	key.field = query
+	key.keyset = true
+
+	return key
+}
+
+// String returns the Redis key
+func (k *hashKey) String() string {
+	return k.key
+}
+
+// Get gets the field, a key that is not a hash yet holds a value from before the
+// key was tagged and is a miss
+func (k *hashKey) Get() ([]byte, error) {
+	if !k.keyset {
+		return nil, redis.ErrKeyNotSet
+	}
+
+	result, err := redis.Cache.HGet(k.key, k.field)
+	if wrongType(err) {
+		return nil, ErrCacheMiss
+	}
+
+	return result, err
+}
+
+// Set sets the field and expires the hash, replacing a value from before the key
+// was tagged
+func (k *hashKey) Set(data []byte) error {
+	if !k.keyset {
+		return redis.ErrKeyNotSet
+	}
+
+	err := redis.Cache.HMSet(k.key, k.field, data)
+	if wrongType(err) {
+		if err = redis.Cache.Delete(k.key); err == nil {
+			err = redis.Cache.HMSet(k.key, k.field, data)
+		}
+	}
+
+	if err != nil || k.expire == 0 {
+		return err
+	}
+
+	return redis.Cache.Expire(k.key, k.expire)
+}
+
+// wrongType reports whether Redis refused a command for the type of the key
+func wrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
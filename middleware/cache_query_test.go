@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/eirka/eirka-libs/config"
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheQuery(t *testing.T) {
+
+	config.Settings.Limits.ThreadsPerPage = 10
+	config.Settings.Limits.PostsPerThread = 5
+	config.Settings.Limits.PostsPerPage = 50
+	config.Settings.Limits.TagMaxLength = 32
+	config.Settings.Limits.ParamMaxSize = 4294967295
+
+	tests := []struct {
+		route string
+		query string
+		want  string
+		ok    bool
+	}{
+		{"index", "", "", true},
+		{"index", "threads=10&posts=5", "", true},
+		{"index", "posts=3", "posts=3", true},
+		{"index", "threads=15&posts=3", "posts=3&threads=15", true},
+		{"index", "posts=3&threads=15", "posts=3&threads=15", true},
+		{"index", "threads=100", "threads=20", true},
+		{"index", "threads=1", "threads=5", true},
+		{"index", "threads=abc", "", false},
+		{"index", "threads=", "", false},
+		{"index", "threads=10&threads=11", "", false},
+		{"index", "what=2", "", false},
+		{"thread", "posts=500", "posts=100", true},
+		{"thread", "posts=50", "", true},
+		{"tagsearch", "", "", false},
+		{"tagsearch", "search=%20touhou%20", "search=+touhou+", true},
+		{"tagsearch", "search=" + url.QueryEscape("an extremely long tag search term that is too long"), "", false},
+		{"image", "", "", true},
+		{"image", "posts=5", "", false},
+	}
+
+	for _, test := range tests {
+		values, err := url.ParseQuery(test.query)
+		assert.NoError(t, err, "An error was not expected")
+
+		query, ok := cacheQuery(test.route, values)
+		assert.Equal(t, test.ok, ok, "Cacheable should match for %s?%s", test.route, test.query)
+		assert.Equal(t, test.want, query, "Query should match for %s?%s", test.route, test.query)
+	}
+}
+
+func TestNewCacheKey(t *testing.T) {
+
+	index, ok := newCacheKey([]string{"index", "1", "2"}, "posts=3", "")
+	assert.True(t, ok, "Route should be cached")
+	assert.Equal(t, "index:1", index.Key, "Key should match")
+	assert.Equal(t, "2?posts=3", index.Field, "Field should match")
+
+	tags, _ := newCacheKey([]string{"tagsearch", "1"}, "search=touhou", "")
+	assert.Equal(t, "tagsearch:1", tags.Key, "Key should match")
+
+	_, ok = newCacheKey([]string{"whoami", "1"}, "", "")
+	assert.False(t, ok, "Unknown routes should not have a key")
+
+	bad, _ := newCacheKey([]string{"tagsearch", "1", "2"}, "search=touhou", "")
+	_, err := Store.Get(bad)
+	assert.Equal(t, redis.ErrKeyNotSet, err, "Error should match")
+}
+
+// TestCacheWithQuery tests that whitelisted query parameters are cached under
+// their own hash field while unknown parameters bypass the cache
+func TestCacheWithQuery(t *testing.T) {
+
+	gin.SetMode(gin.ReleaseMode)
+
+	config.Settings.Limits.ThreadsPerPage = 10
+	config.Settings.Limits.PostsPerThread = 5
+	config.Settings.Limits.TagMaxLength = 32
+	config.Settings.Limits.ParamMaxSize = 4294967295
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	router := gin.New()
+	router.Use(Cache())
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		c.String(200, "not cached")
+	})
+
+	router.GET("/tagsearch/:ib", func(c *gin.Context) {
+		c.String(200, "not cached")
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	store.Set(CacheKey{Key: "index:1", Field: "1?posts=3&threads=15"}, []byte(`{"index":"query"}`), 0)
+	store.Set(CacheKey{Key: "tagsearch:1", Field: "search=touhou"}, []byte(`{"tagsearch":[]}`), 0)
+
+	index := performRequest(router, "GET", "/index/1/1?threads=15&posts=3")
+	assert.Equal(t, 200, index.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"query"}`, index.Body.String(), "Body should match")
+
+	search := performRequest(router, "GET", "/tagsearch/1?search=touhou")
+	assert.Equal(t, 200, search.Code, "HTTP request code should match")
+	assert.Equal(t, `{"tagsearch":[]}`, search.Body.String(), "Body should match")
+
+	unknown := performRequest(router, "GET", "/index/1/1?threads=15&sort=new")
+	assert.Equal(t, 200, unknown.Code, "HTTP request code should match")
+	assert.Equal(t, "not cached", unknown.Body.String(), "Unknown parameters should bypass the cache")
+}
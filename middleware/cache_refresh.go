@@ -0,0 +1,192 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// errFillTimeout is returned when a controller outlives the fill timeout
+var errFillTimeout = errors.New("controller timed out")
+
+// detachedEngine backs the contexts used to run handlers without a client attached
+var detachedEngine = gin.New()
+
+// cacheTarget identifies where a response is cached
+type cacheTarget struct {
+	// route is the first path segment, e.g. "index"
+	route string
+	// key is the cache store key for the response
+	key CacheKey
+	// sfKey is used for singleflight deduplication and as the memory cache key
+	sfKey string
+	// schema is the schema tag entries are stored with
+	schema string
+}
+
+// current reports whether an entry read from Redis may be served for the target
+func (target *cacheTarget) current(entry *cacheEntry) bool {
+	return !entry.expired() && entry.Schema == target.schema
+}
+
+// refreshing holds the singleflight keys that currently have a background refresh running
+var refreshing sync.Map
+
+// refreshEntry rebuilds a stale cache entry in the background while the caller
+// serves the stale copy. Only one refresh runs per key, and it shares the
+// singleflight group with cache misses so a miss that arrives mid-refresh waits
+// on the refresh instead of starting its own query.
+func refreshEntry(c *gin.Context, target *cacheTarget, stale *cacheEntry, config CacheConfig) {
+	// Skip if a refresh for this key is already running
+	if _, running := refreshing.LoadOrStore(target.sfKey, true); running {
+		return
+	}
+
+	// Snapshot everything the handler needs now, gin recycles the request
+	// context as soon as the response has been written
+	handler := c.Handler()
+	snapshot := c.Copy()
+
+	go func() {
+		defer refreshing.Delete(target.sfKey)
+
+		// Leave the refresh to another instance if it already holds the lease,
+		// the stale entry keeps being served until that instance stores its entry
+		if leaseEnabled(config) {
+			lease, err := acquireLease(target, config.LeaseTTL)
+			if err == nil && lease == nil {
+				return
+			}
+			defer lease.release()
+		}
+
+		// Errors are dropped here, the stale entry keeps being served and the
+		// next request past the freshness window will try again
+		_, _, _ = Group.Do(target.sfKey, func() (any, error) {
+			entry, _, err := fillEntry(handler, snapshot, config.FillTimeout)
+			if err != nil {
+				return nil, err
+			}
+
+			if entry.cacheable() {
+				entry.keepModified(stale)
+				_ = entry.compress(config.Encodings, config.CompressMinSize)
+				_ = storeEntry(target, entry)
+			}
+
+			return entry, nil
+		})
+	}()
+}
+
+// fillEntry runs the handler for a fill if the database circuit allows it, and
+// reports how the database did to the breaker
+func fillEntry(handler gin.HandlerFunc, snapshot *gin.Context, timeout time.Duration) (*cacheEntry, []*gin.Error, error) {
+	if !DatabaseCircuitBreaker.AllowRequest() {
+		return nil, nil, errDatabaseOpen
+	}
+
+	entry, errs, err := runDetached(handler, snapshot, timeout)
+
+	recordDatabase(errs, err)
+
+	return entry, errs, err
+}
+
+// runDetached runs a route handler against a response recorder instead of a client
+// connection, so the request that triggered it can go away without cancelling it.
+// It returns the recorded response along with any errors the handler logged. Only
+// timeouts and panics are returned as errors, error responses are returned as entries.
+func runDetached(handler gin.HandlerFunc, snapshot *gin.Context, timeout time.Duration) (*cacheEntry, []*gin.Error, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	recorder := httptest.NewRecorder()
+
+	dc := gin.CreateTestContextOnly(recorder, detachedEngine)
+	dc.Request = snapshot.Request.WithContext(ctx)
+	dc.Params = snapshot.Params
+	dc.Keys = snapshot.Keys
+
+	done := make(chan struct{})
+	start := time.Now()
+
+	var panicked any
+
+	go func() {
+		defer close(done)
+		defer func() {
+			panicked = recover()
+		}()
+		handler(dc)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return nil, nil, fmt.Errorf("%w after %v", errFillTimeout, timeout)
+	}
+
+	if panicked != nil {
+		return nil, dc.Errors, fmt.Errorf("controller panicked: %v", panicked)
+	}
+
+	entry := newCacheEntry(recorder.Body.Bytes())
+	entry.Delta = time.Since(start)
+
+	if recorder.Code != http.StatusOK {
+		entry.Status = recorder.Code
+	}
+
+	if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+		entry.Type = contentType
+	}
+
+	return entry, dc.Errors, nil
+}
+
+// storeEntry writes an entry to the memory cache and the cache store, reporting
+// the store outcome to the circuit breaker
+func storeEntry(target *cacheTarget, entry *cacheEntry) error {
+	entry.Schema = target.schema
+
+	// The memory cache does not depend on Redis being healthy
+	InMemoryCache.Set(target.route, target.sfKey, entry)
+
+	// Only attempt to cache if circuit breaker still allows it
+	// This ensures we respect the circuit breaker's decision on using Redis
+	if !CircuitBreaker.AllowRequest() {
+		return nil
+	}
+
+	raw, err := encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	// Negative entries expire on their own so entries for resources that never
+	// existed do not pile up in the store
+	ttl := time.Duration(0)
+	if !entry.Expires.IsZero() {
+		ttl = max(time.Second, time.Until(entry.Expires))
+	}
+
+	start := time.Now()
+
+	if err := Store.Set(target.key, raw, ttl); err != nil {
+		CircuitBreaker.RecordFailure()
+		return err
+	}
+
+	// Record successful cache operation which will close the circuit
+	// if we're in half-open state
+	CircuitBreaker.RecordDuration(time.Since(start))
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package middleware
+
+import (
+	"strconv"
+	"strings"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+// CacheSchemas holds the schema version of each route's JSON, keyed by the first path
+// segment. Bump a route's version when its model output changes shape so a deploy
+// stops reading entries written by the previous version. Routes without a version
+// are at version zero.
+var CacheSchemas = map[string]uint{}
+
+// schemaSeparator separates the schema tag from the rest of a hash field, it cannot
+// appear in ids or in a canonical query since query values are escaped
+const schemaSeparator = "#"
+
+// schemaTag returns the tag entries of a route are stored under for a namespace.
+// The tag is empty without a namespace at version zero so those entries keep the
+// fields they have always had.
+func schemaTag(namespace, route string) string {
+	version := CacheSchemas[route]
+
+	if namespace == "" && version == 0 {
+		return ""
+	}
+
+	tag := "v" + strconv.FormatUint(uint64(version), 10)
+
+	if namespace != "" {
+		tag = namespace + "/" + tag
+	}
+
+	return tag
+}
+
+// currentTag reports whether a hash field was written with the given tag, and
+// whether it belongs to the namespace at all. Fields from other namespaces are
+// left alone, they belong to other deployments sharing the Redis server.
+func currentTag(field, namespace, tag string) (current, owned bool) {
+	fieldTag := ""
+	if i := strings.LastIndex(field, schemaSeparator); i >= 0 {
+		fieldTag = field[i+1:]
+	}
+
+	fieldNamespace, _, namespaced := strings.Cut(fieldTag, "/")
+	if !namespaced {
+		fieldNamespace = ""
+	}
+
+	if fieldNamespace != namespace {
+		return false, false
+	}
+
+	return fieldTag == tag, true
+}
+
+// schemaScanCount is how many keys or fields each SCAN step asks Redis for
+const schemaScanCount = 100
+
+// CollectSchemas deletes hash fields written under an old schema version of this
+// namespace, which nothing reads anymore once a route's version is bumped. It walks
+// the keyspace with SCAN so it can run in the background of a live server, and
+// returns the number of fields deleted. Tagged plain keys are hashes of their own
+// and are collected the same way. Stores other than Redis do not outlive the
+// process and have nothing to collect.
+func CollectSchemas(config CacheConfig) (int, error) {
+	if !storeShared() {
+		return 0, nil
+	}
+
+	var routes []string
+
+	for route := range redis.RedisKeyIndex {
+		routes = append(routes, route)
+	}
+
+	for route := range searchKeys {
+		routes = append(routes, route)
+	}
+
+	deleted := 0
+
+	for _, route := range routes {
+		tag := schemaTag(config.Namespace, route)
+		if tag == "" {
+			continue
+		}
+
+		count, err := collectRoute(route, config.Namespace, tag)
+		deleted += count
+		if err != nil {
+			return deleted, err
+		}
+	}
+
+	return deleted, nil
+}
+
+// collectRoute deletes the stale fields from every hash of a route, including the
+// key named after the route for routes that take no ids
+func collectRoute(route, namespace, tag string) (int, error) {
+	conn := redis.Cache.Pool.Get()
+	defer conn.Close()
+
+	deleted := 0
+	cursor := 0
+
+	if key := redis.NewKey(route); key != nil && key.SetKey().String() == route {
+		kind, err := redigo.String(conn.Do("TYPE", route))
+		if err != nil {
+			return deleted, err
+		}
+
+		if kind == "hash" {
+			deleted, err = collectKey(conn, route, namespace, tag)
+			if err != nil {
+				return deleted, err
+			}
+		}
+	}
+
+	for {
+		values, err := redigo.Values(conn.Do("SCAN", cursor, "MATCH", route+":*", "COUNT", schemaScanCount, "TYPE", "hash"))
+		if err != nil {
+			return deleted, err
+		}
+
+		var keys []string
+
+		_, err = redigo.Scan(values, &cursor, &keys)
+		if err != nil {
+			return deleted, err
+		}
+
+		for _, key := range keys {
+			count, err := collectKey(conn, key, namespace, tag)
+			deleted += count
+			if err != nil {
+				return deleted, err
+			}
+		}
+
+		if cursor == 0 {
+			return deleted, nil
+		}
+	}
+}
+
+// collectKey deletes the fields of one hash that have an old tag
+func collectKey(conn redigo.Conn, key, namespace, tag string) (int, error) {
+	fields, err := redigo.Strings(conn.Do("HKEYS", key))
+	if err != nil {
+		return 0, err
+	}
+
+	stale := []any{key}
+
+	for _, field := range fields {
+		if current, owned := currentTag(field, namespace, tag); owned && !current {
+			stale = append(stale, field)
+		}
+	}
+
+	if len(stale) == 1 {
+		return 0, nil
+	}
+
+	return redigo.Int(conn.Do("HDEL", stale...))
+}
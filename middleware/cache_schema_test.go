@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	redigo "github.com/gomodule/redigo/redis"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaTag(t *testing.T) {
+	CacheSchemas = map[string]uint{"thread": 3}
+	defer func() { CacheSchemas = map[string]uint{} }()
+
+	assert.Empty(t, schemaTag("", "index"), "Tag should be empty")
+	assert.Equal(t, "v3", schemaTag("", "thread"), "Tag should match")
+	assert.Equal(t, "staging/v0", schemaTag("staging", "index"), "Tag should match")
+	assert.Equal(t, "staging/v3", schemaTag("staging", "thread"), "Tag should match")
+
+	for _, test := range []struct {
+		field     string
+		namespace string
+		tag       string
+		current   bool
+		owned     bool
+	}{
+		{"1", "", "v3", false, true},
+		{"1#v2", "", "v3", false, true},
+		{"1#v3", "", "v3", true, true},
+		{"1?posts=3#v3", "", "v3", true, true},
+		{"1#staging/v3", "", "v3", false, false},
+		{"1#staging/v2", "staging", "staging/v3", false, true},
+		{"1#v3", "staging", "staging/v3", false, false},
+		{"1", "staging", "staging/v3", false, false},
+	} {
+		current, owned := currentTag(test.field, test.namespace, test.tag)
+		assert.Equal(t, test.current, current, "Current should match for %s", test.field)
+		assert.Equal(t, test.owned, owned, "Owned should match for %s", test.field)
+	}
+
+	assert.True(t, isHashKey([]string{"index", "1", "2"}), "Index should be a hash")
+	assert.True(t, isHashKey([]string{"thread", "1", "2", "3"}), "Thread should be a hash")
+	assert.False(t, isHashKey([]string{"new", "1"}), "New should be a plain key")
+	assert.False(t, isHashKey([]string{"tagtypes"}), "Tagtypes should be a plain key")
+	assert.False(t, isHashKey([]string{"whoami", "1"}), "Unknown routes should not be a hash")
+
+	// the tag goes in the hash field so deleting the key still invalidates it
+	thread, _ := newCacheKey([]string{"thread", "1", "2", "3"}, "posts=50", schemaTag("", "thread"))
+	assert.Equal(t, "thread:1:2", thread.Key, "Key should match")
+
+	// plain keys become a hash under the same name with the tag as the field
+	plain, _ := newCacheKey([]string{"new", "1"}, "", "v3")
+	assert.Equal(t, "new:1", plain.Key, "Key should match")
+	assert.Equal(t, "#v3", plain.Field, "Field should match")
+
+	staging, _ := newCacheKey([]string{"tagtypes"}, "", "staging/v1")
+	assert.Equal(t, "tagtypes", staging.Key, "Key should match")
+	assert.Equal(t, "#staging/v1", staging.Field, "Field should match")
+
+	untagged, _ := newCacheKey([]string{"tagtypes"}, "", "")
+	assert.Equal(t, "tagtypes", untagged.Key, "Key should match")
+	assert.Empty(t, untagged.Field, "Untagged plain keys should stay plain")
+
+	search, _ := newCacheKey([]string{"tagsearch", "1"}, "search=touhou", "v3")
+	assert.Equal(t, "search=touhou#v3", search.Field, "Field should match")
+}
+
+func TestCacheSchemaVersion(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	CacheSchemas = map[string]uint{"index": 2, "tagtypes": 1}
+	defer func() { CacheSchemas = map[string]uint{} }()
+
+	router := gin.New()
+	router.Use(Cache())
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		c.Data(200, "application/json", []byte(`{"index":"v2"}`))
+	})
+
+	router.GET("/tagtypes", func(c *gin.Context) {
+		c.Data(200, "application/json", []byte(`{"tagtypes":"v1"}`))
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	// hash keys read and write the versioned field
+	index := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, `{"index":"v2"}`, index.Body.String(), "Body should match")
+
+	_, err := store.MemoryStore.Get(CacheKey{Key: "index:1", Field: "1#v2"})
+	assert.NoError(t, err, "Entry should be stored under the versioned field")
+
+	// plain keys written under an older version are a different entry
+	old, err := encodeEntry(&cacheEntry{Stored: time.Now(), Body: []byte(`{"tagtypes":"v0"}`)})
+	assert.NoError(t, err, "An error was not expected")
+
+	store.Set(CacheKey{Key: "tagtypes"}, old, 0)
+	store.Set(CacheKey{Key: "tagtypes", Field: "#v0"}, old, 0)
+
+	tagtypes := performRequest(router, "GET", "/tagtypes")
+	assert.Equal(t, `{"tagtypes":"v1"}`, tagtypes.Body.String(), "Body should match")
+
+	entry, ok := InMemoryCache.Get("tagtypes")
+	assert.True(t, ok, "Entry should be in memory")
+	assert.Equal(t, "v1", entry.Schema, "Schema should be stored")
+
+	// the older version keeps its entry for instances still running it
+	data, err := store.MemoryStore.Get(CacheKey{Key: "tagtypes", Field: "#v0"})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, `{"tagtypes":"v0"}`, string(decodeEntry(data).Body), "Old entry should be kept")
+
+	data, err = store.MemoryStore.Get(CacheKey{Key: "tagtypes", Field: "#v1"})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, `{"tagtypes":"v1"}`, string(decodeEntry(data).Body), "Entry should be stored under its tag")
+}
+
+func TestPlainHashKey(t *testing.T) {
+	redis.NewRedisMock()
+
+	key, _ := newCacheKey([]string{"imageboards"}, "", "v1")
+
+	// a plain value from before the key was tagged is a miss and is replaced
+	redis.Cache.Mock.Command("HGET", "imageboards", "#v1").
+		ExpectError(redigo.Error("WRONGTYPE Operation against a key holding the wrong kind of value"))
+	redis.Cache.Mock.Command("GET", "notfound:imageboards:#v1").Expect(nil)
+
+	_, err := NewRedisStore().Get(key)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+
+	var sets atomic.Int32
+	redis.Cache.Mock.Command("HMSET", "imageboards", "#v1", []byte("boards")).Handle(func(args []any) (any, error) {
+		if sets.Add(1) == 1 {
+			return nil, redigo.Error("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		return "OK", nil
+	})
+	del := redis.Cache.Mock.Command("DEL", "imageboards").Expect(int64(1))
+	expire := redis.Cache.Mock.Command("EXPIRE", "imageboards", uint(600)).Expect(int64(1))
+
+	assert.NoError(t, NewRedisStore().Set(key, []byte("boards"), 0), "An error was not expected")
+	assert.Equal(t, int32(2), sets.Load(), "Field should be written again")
+	assert.Equal(t, 1, redis.Cache.Mock.Stats(del), "Plain value should be deleted")
+	assert.Equal(t, 1, redis.Cache.Mock.Stats(expire), "Hash should expire like the plain key")
+}
+
+func TestCollectSchemas(t *testing.T) {
+	CacheSchemas = map[string]uint{"index": 2, "tagtypes": 2}
+	defer func() { CacheSchemas = map[string]uint{} }()
+
+	redis.NewRedisMock()
+
+	redis.Cache.Mock.Command("SCAN", 0, "MATCH", "index:*", "COUNT", 100, "TYPE", "hash").
+		Expect([]any{[]byte("7"), []any{[]byte("index:1")}})
+	redis.Cache.Mock.Command("SCAN", 7, "MATCH", "index:*", "COUNT", 100, "TYPE", "hash").
+		Expect([]any{[]byte("0"), []any{[]byte("index:2")}})
+
+	redis.Cache.Mock.Command("HKEYS", "index:1").
+		Expect([]any{[]byte("1"), []byte("1#v2"), []byte("2?posts=3#v1"), []byte("1#staging/v1")})
+	redis.Cache.Mock.Command("HKEYS", "index:2").
+		Expect([]any{[]byte("1#v2")})
+
+	del := redis.Cache.Mock.Command("HDEL", "index:1", "1", "2?posts=3#v1").Expect(int64(2))
+
+	// a tagged plain key is a hash named after the route
+	redis.Cache.Mock.Command("TYPE", "tagtypes").Expect("hash")
+	redis.Cache.Mock.Command("SCAN", 0, "MATCH", "tagtypes:*", "COUNT", 100, "TYPE", "hash").
+		Expect([]any{[]byte("0"), []any{}})
+	redis.Cache.Mock.Command("HKEYS", "tagtypes").
+		Expect([]any{[]byte("#v1"), []byte("#v2")})
+
+	plain := redis.Cache.Mock.Command("HDEL", "tagtypes", "#v1").Expect(int64(1))
+
+	deleted, err := CollectSchemas(DefaultCacheConfig)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, 3, deleted, "Deleted count should match")
+	assert.Equal(t, 1, redis.Cache.Mock.Stats(del), "Old fields should be deleted")
+	assert.Equal(t, 1, redis.Cache.Mock.Stats(plain), "Old plain key fields should be deleted")
+}
@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+)
+
+var (
+	// ErrCacheMiss is returned by a cache store when a key holds no entry
+	ErrCacheMiss = redis.ErrCacheMiss
+	// ErrKeyNotSet is returned by a cache store for a key that could not be built from the request
+	ErrKeyNotSet = redis.ErrKeyNotSet
+)
+
+// CacheKey identifies a cache entry. It follows the eirka-libs key layout so entries
+// in Redis are still removed when eirka-post or eirka-admin delete the key.
+type CacheKey struct {
+	// Key is the key name, e.g. "index:1"
+	Key string
+	// Field is the hash field within the key, empty for plain keys
+	Field string
+	// keyer is the Redis key that knows how the route's keys expire and unlock
+	keyer cacheKeyer
+}
+
+// CacheStore is where the cache middleware keeps entries between requests
+type CacheStore interface {
+	// Get returns the data stored for a key or ErrCacheMiss
+	Get(key CacheKey) ([]byte, error)
+	// Set stores the data for a key, a positive ttl expires it after that long
+	// while zero keeps the store's default lifetime for the key
+	Set(key CacheKey, data []byte, ttl time.Duration) error
+	// Delete removes a key along with all of its fields
+	Delete(key CacheKey) error
+}
+
+// Store is the cache store used by the middleware, Redis unless the install
+// has no Redis server
+var Store CacheStore = NewRedisStore()
+
+// storeShared reports whether the store is shared with other instances, which
+// fill leases and schema collection need
+func storeShared() bool {
+	_, ok := Store.(*RedisStore)
+	return ok
+}
+
+// RedisStore keeps entries in Redis through eirka-libs, shared with the other
+// instances and services
+type RedisStore struct{}
+
+// NewRedisStore returns a store using the eirka-libs Redis cache
+func NewRedisStore() *RedisStore {
+	return &RedisStore{}
+}
+
+// Get gets an entry from Redis, falling back to the negative entry for the key
+func (s *RedisStore) Get(key CacheKey) ([]byte, error) {
+	var result []byte
+	var err error
+
+	switch {
+	case key.keyer != nil:
+		result, err = key.keyer.Get()
+	case key.Key == "":
+		return nil, ErrKeyNotSet
+	case key.Field != "":
+		result, err = redis.Cache.HGet(key.Key, key.Field)
+	default:
+		result, err = redis.Cache.Get(key.Key)
+	}
+
+	if err != ErrCacheMiss {
+		return result, err
+	}
+
+	return redis.Cache.Get(negativeKey(key))
+}
+
+// Set stores an entry in Redis, keys from eirka-libs expire and unlock the way
+// they always have. Entries with a ttl are negative entries and get a key of
+// their own instead.
+func (s *RedisStore) Set(key CacheKey, data []byte, ttl time.Duration) error {
+	switch {
+	case key.Key == "":
+		return ErrKeyNotSet
+	case ttl > 0:
+		return redis.Cache.SetEx(negativeKey(key), uint(max(1, math.Ceil(ttl.Seconds()))), data)
+	case key.keyer != nil:
+		return key.keyer.Set(data)
+	case key.Field != "":
+		return redis.Cache.HMSet(key.Key, key.Field, data)
+	default:
+		return redis.Cache.Set(key.Key, data)
+	}
+}
+
+// Delete deletes a key from Redis along with its negative entry
+func (s *RedisStore) Delete(key CacheKey) error {
+	if key.Key == "" {
+		return ErrKeyNotSet
+	}
+
+	return redis.Cache.Delete(key.Key, negativeKey(key))
+}
+
+// negativeKey is the key a negative entry is kept under. A not found entry in the
+// hash of a route would never expire without taking the real pages next to it
+// along, so each one gets its own key that Redis expires on its own.
+func negativeKey(key CacheKey) string {
+	if key.Field == "" {
+		return "notfound:" + key.Key
+	}
+
+	return "notfound:" + key.Key + ":" + key.Field
+}
+
+// DefaultMemoryStoreSize is the size of a memory store in bytes
+const DefaultMemoryStoreSize = 256 * 1024 * 1024
+
+// MemoryStore keeps entries in process for local development and single node
+// installs without Redis. Nothing outside the process can invalidate it, so
+// entries are only as current as the cache refresh keeps them.
+type MemoryStore struct {
+	mu      sync.Mutex
+	maxSize int
+	size    int
+	keys    map[string]map[string]storedValue
+}
+
+// storedValue is an entry in a memory store
+type storedValue struct {
+	data    []byte
+	expires time.Time
+}
+
+// NewMemoryStore returns a memory store holding at most maxSize bytes
+func NewMemoryStore(maxSize int) *MemoryStore {
+	return &MemoryStore{
+		maxSize: maxSize,
+		keys:    make(map[string]map[string]storedValue),
+	}
+}
+
+// Get gets an entry from memory
+func (s *MemoryStore) Get(key CacheKey) ([]byte, error) {
+	if key.Key == "" {
+		return nil, ErrKeyNotSet
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	value, ok := s.keys[key.Key][key.Field]
+	if !ok {
+		return nil, ErrCacheMiss
+	}
+
+	if !value.expires.IsZero() && time.Now().After(value.expires) {
+		s.remove(key.Key, key.Field)
+		return nil, ErrCacheMiss
+	}
+
+	return value.data, nil
+}
+
+// Set stores an entry in memory, entries without a ttl are kept until they are
+// replaced or evicted. Whole keys are evicted when the store is full.
+func (s *MemoryStore) Set(key CacheKey, data []byte, ttl time.Duration) error {
+	if key.Key == "" {
+		return ErrKeyNotSet
+	}
+
+	size := len(key.Key) + len(key.Field) + len(data)
+	if size > s.maxSize {
+		return nil
+	}
+
+	value := storedValue{data: data}
+	if ttl > 0 {
+		value.expires = time.Now().Add(ttl)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.remove(key.Key, key.Field)
+
+	for name := range s.keys {
+		if s.size+size <= s.maxSize {
+			break
+		}
+		s.removeKey(name)
+	}
+
+	fields, ok := s.keys[key.Key]
+	if !ok {
+		fields = make(map[string]storedValue)
+		s.keys[key.Key] = fields
+	}
+
+	fields[key.Field] = value
+	s.size += size
+
+	return nil
+}
+
+// Delete removes a key and its fields from memory
+func (s *MemoryStore) Delete(key CacheKey) error {
+	if key.Key == "" {
+		return ErrKeyNotSet
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.removeKey(key.Key)
+
+	return nil
+}
+
+// Size returns the number of bytes held by the store
+func (s *MemoryStore) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// remove drops a field, the caller must hold the lock
+func (s *MemoryStore) remove(name, field string) {
+	value, ok := s.keys[name][field]
+	if !ok {
+		return
+	}
+
+	s.size -= len(name) + len(field) + len(value.data)
+	delete(s.keys[name], field)
+
+	if len(s.keys[name]) == 0 {
+		delete(s.keys, name)
+	}
+}
+
+// removeKey drops a key with all of its fields, the caller must hold the lock
+func (s *MemoryStore) removeKey(name string) {
+	for field := range s.keys[name] {
+		s.remove(name, field)
+	}
+}
+
+// NoopStore stores nothing, every request misses and goes to the controller
+// with only the memory cache in front of it
+type NoopStore struct{}
+
+// NewNoopStore returns a store that stores nothing
+func NewNoopStore() *NoopStore {
+	return &NoopStore{}
+}
+
+// Get always misses
+func (s *NoopStore) Get(key CacheKey) ([]byte, error) {
+	if key.Key == "" {
+		return nil, ErrKeyNotSet
+	}
+
+	return nil, ErrCacheMiss
+}
+
+// Set discards the entry
+func (s *NoopStore) Set(key CacheKey, data []byte, ttl time.Duration) error {
+	return nil
+}
+
+// Delete does nothing
+func (s *NoopStore) Delete(key CacheKey) error {
+	return nil
+}
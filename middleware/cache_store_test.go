@@ -0,0 +1,164 @@
+package middleware
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eirka/eirka-libs/redis"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore(64)
+
+	first := CacheKey{Key: "index:1", Field: "1"}
+	second := CacheKey{Key: "index:1", Field: "2"}
+
+	_, err := store.Get(first)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+
+	assert.NoError(t, store.Set(first, []byte("one"), 0), "An error was not expected")
+	assert.NoError(t, store.Set(second, []byte("two"), 0), "An error was not expected")
+
+	data, err := store.Get(first)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("one"), data, "Data should match")
+
+	// replacing a field does not grow the store
+	size := store.Size()
+	assert.NoError(t, store.Set(first, []byte("uno"), 0), "An error was not expected")
+	assert.Equal(t, size, store.Size(), "Size should match")
+
+	// deleting a key removes all of its fields like it does in Redis
+	assert.NoError(t, store.Delete(CacheKey{Key: "index:1"}), "An error was not expected")
+	_, err = store.Get(second)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+	assert.Zero(t, store.Size(), "Store should be empty")
+
+	// entries with a ttl expire
+	assert.NoError(t, store.Set(first, []byte("one"), time.Millisecond), "An error was not expected")
+	time.Sleep(5 * time.Millisecond)
+	_, err = store.Get(first)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+
+	// a full store evicts keys to make room
+	assert.NoError(t, store.Set(CacheKey{Key: "thread:1:1", Field: "1"}, make([]byte, 40), 0), "An error was not expected")
+	assert.NoError(t, store.Set(CacheKey{Key: "thread:1:2", Field: "1"}, make([]byte, 40), 0), "An error was not expected")
+	assert.LessOrEqual(t, store.Size(), 64, "Store should not exceed its size")
+
+	_, err = store.Get(CacheKey{Key: "thread:1:2", Field: "1"})
+	assert.NoError(t, err, "An error was not expected")
+
+	// entries larger than the store are not kept
+	assert.NoError(t, store.Set(first, make([]byte, 100), 0), "An error was not expected")
+	_, err = store.Get(first)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+
+	_, err = store.Get(CacheKey{})
+	assert.Equal(t, ErrKeyNotSet, err, "Error should match")
+}
+
+func TestRedisStoreNotFound(t *testing.T) {
+	redis.NewRedisMock()
+
+	store := NewRedisStore()
+
+	found := CacheKey{Key: "image:1", Field: "1"}
+	missing := CacheKey{Key: "image:1", Field: "2"}
+
+	// the hash already holds a real page
+	redis.Cache.Mock.Command("HGET", "image:1", "1").Expect([]byte("page"))
+	redis.Cache.Mock.Command("HGET", "image:1", "2").Expect(nil)
+
+	// the negative entry gets its own key and the hash is never expired
+	setex := redis.Cache.Mock.Command("SETEX", "notfound:image:1:2", uint(30), []byte("missing")).Expect("OK")
+	expire := redis.Cache.Mock.GenericCommand("EXPIRE").Expect(int64(1))
+	hmset := redis.Cache.Mock.GenericCommand("HMSET").Expect("OK")
+
+	assert.NoError(t, store.Set(missing, []byte("missing"), 30*time.Second), "An error was not expected")
+	assert.Equal(t, 1, redis.Cache.Mock.Stats(setex), "Negative entry should be stored")
+	assert.Zero(t, redis.Cache.Mock.Stats(expire), "Hash should not be expired")
+	assert.Zero(t, redis.Cache.Mock.Stats(hmset), "Hash should not be written")
+
+	redis.Cache.Mock.Command("GET", "notfound:image:1:2").Expect([]byte("missing"))
+
+	data, err := store.Get(found)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("page"), data, "Page should be served from the hash")
+
+	data, err = store.Get(missing)
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte("missing"), data, "Negative entry should be served")
+
+	// once the negative entry expires the field is a miss
+	redis.Cache.Mock.Command("GET", "notfound:image:1:2").Expect(nil)
+
+	_, err = store.Get(missing)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+
+	// a real page in a new hash does not expire
+	redis.Cache.Mock.Command("HMSET", "image:2", "1", []byte("page")).Expect("OK")
+
+	assert.NoError(t, store.Set(CacheKey{Key: "image:2", Field: "1"}, []byte("page"), 0), "An error was not expected")
+	assert.Zero(t, redis.Cache.Mock.Stats(expire), "Hash should not be expired")
+}
+
+func TestNoopStore(t *testing.T) {
+	store := NewNoopStore()
+
+	key := CacheKey{Key: "index:1", Field: "1"}
+
+	assert.NoError(t, store.Set(key, []byte("one"), 0), "An error was not expected")
+
+	_, err := store.Get(key)
+	assert.Equal(t, ErrCacheMiss, err, "Error should match")
+
+	assert.NoError(t, store.Delete(key), "An error was not expected")
+}
+
+func TestCacheMemoryStore(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	Store = NewMemoryStore(DefaultMemoryStoreSize)
+	defer func() { Store = NewRedisStore() }()
+
+	var calls atomic.Int32
+
+	config := DefaultCacheConfig
+	// leases need a shared store and are skipped
+	config.LeaseTTL = time.Second
+
+	router := gin.New()
+	router.Use(CacheWithConfig(config))
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		calls.Add(1)
+		c.Data(200, "application/json", []byte(`{"index":"test"}`))
+	})
+
+	first := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, first.Code, "HTTP request code should match")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should run")
+
+	// the entry is kept under the same key and field as in Redis
+	data, err := Store.Get(CacheKey{Key: "index:1", Field: "1"})
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, []byte(`{"index":"test"}`), decodeEntry(data).Body, "Body should match")
+
+	// with the memory tier cleared the entry comes from the store
+	InMemoryCache = NewMemoryCache()
+
+	second := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, second.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"test"}`, second.Body.String(), "Body should match")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should not run")
+
+	// paths that do not fit the route's key are rejected like they are with Redis
+	bad := performRequest(router, "GET", "/index/1/1/1")
+	assert.Equal(t, 400, bad.Code, "HTTP request code should match")
+}
@@ -1,17 +1,76 @@
 package middleware
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/eirka/eirka-libs/redis"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 )
 
 // Use performRequest from analytics_test.go
 
+// testStore is a memory store that can be made to fail and counts the calls the
+// middleware makes, so the cache tests do not depend on Redis
+type testStore struct {
+	*MemoryStore
+	mu     sync.Mutex
+	getErr error
+	setErr error
+	gets   atomic.Int32
+	sets   atomic.Int32
+}
+
+// newTestStore returns an empty test store
+func newTestStore() *testStore {
+	return &testStore{MemoryStore: NewMemoryStore(DefaultMemoryStoreSize)}
+}
+
+// fail makes the following gets and sets return the given errors, nil clears them
+func (s *testStore) fail(getErr, setErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.getErr = getErr
+	s.setErr = setErr
+}
+
+// Get counts the call and returns the injected error or the stored entry
+func (s *testStore) Get(key CacheKey) ([]byte, error) {
+	s.gets.Add(1)
+
+	s.mu.Lock()
+	err := s.getErr
+	s.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return s.MemoryStore.Get(key)
+}
+
+// Set counts the call and returns the injected error or stores the entry
+func (s *testStore) Set(key CacheKey, data []byte, ttl time.Duration) error {
+	s.sets.Add(1)
+
+	s.mu.Lock()
+	err := s.setErr
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	return s.MemoryStore.Set(key, data, ttl)
+}
+
 func TestCache(t *testing.T) {
 
 	gin.SetMode(gin.ReleaseMode)
@@ -21,14 +80,7 @@ func TestCache(t *testing.T) {
 	router.Use(Cache())
 
 	router.GET("/index/:ib/:page", func(c *gin.Context) {
-		// Properly use the callback mechanism that the cache middleware expects
-		if _, ok := c.Get("cacheMiss"); ok {
-			// Get the data callback function and use it to send the data
-			if callback, ok := c.Get("setDataCallback"); ok {
-				callback.(func([]byte, error))([]byte("cache data"), nil)
-			}
-		}
-
+		// Not valid JSON so it is served but never stored
 		c.String(200, "not cached")
 	})
 
@@ -41,10 +93,13 @@ func TestCache(t *testing.T) {
 		c.String(200, "OK")
 	})
 
-	redis.NewRedisMock()
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
 
-	// Reset the circuit breaker before tests
+	// Reset the circuit breaker and memory cache before tests
 	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
 
 	// break cache with a query string
 	query := performRequest(router, "GET", "/index/1/2?what=2")
@@ -62,41 +117,38 @@ func TestCache(t *testing.T) {
 	assert.Equal(t, bad.Code, 400, "HTTP request code should match")
 
 	// a controller that returns a controllerError
-	redis.Cache.Mock.Command("HGET", "thread:1:1", "1").Expect(nil)
-
 	controllererror := performRequest(router, "GET", "/thread/1/1/1")
 
 	assert.Equal(t, controllererror.Code, 500, "HTTP request code should match")
 	assert.Equal(t, controllererror.Body.String(), "BAD!!", "Body should match")
 
 	// get a cached query
-	redis.Cache.Mock.Command("HGET", "index:1", "2").Expect("cached")
+	store.Set(CacheKey{Key: "index:1", Field: "2"}, []byte("cached"), 0)
 
 	cached := performRequest(router, "GET", "/index/1/2")
 
 	assert.Equal(t, cached.Body.String(), "cached", "Body should match")
 	assert.Equal(t, cached.Code, 200, "HTTP request code should match")
 
-	// get a cache miss and set data
-	redis.Cache.Mock.Command("HGET", "index:1", "3")
-	redis.Cache.Mock.Command("HMSET", "index:1", "3", []byte("cache data"))
-
+	// get a cache miss, the body is not JSON so nothing is stored
 	getdata := performRequest(router, "GET", "/index/1/3")
 
 	assert.Equal(t, getdata.Body.String(), "not cached", "Body should match")
 	assert.Equal(t, getdata.Code, 200, "HTTP request code should match")
 
-	// a redis get error
-	redis.Cache.Mock.Command("HGET", "index:1", "4").ExpectError(errors.New("get error"))
+	_, err := store.MemoryStore.Get(CacheKey{Key: "index:1", Field: "3"})
+	assert.Equal(t, ErrCacheMiss, err, "Body should not be stored")
+
+	// a store get error
+	store.fail(errors.New("get error"), nil)
 
 	badget := performRequest(router, "GET", "/index/1/4")
 
 	assert.Equal(t, badget.Body.String(), "not cached", "Body should match")
 	assert.Equal(t, badget.Code, 200, "HTTP request code should match")
 
-	// a redis set error
-	redis.Cache.Mock.Command("HGET", "index:1", "4").Expect(nil)
-	redis.Cache.Mock.Command("HMSET", "index:1", "4", []byte("cache data")).ExpectError(errors.New("set error"))
+	// a store set error
+	store.fail(nil, errors.New("set error"))
 
 	badset := performRequest(router, "GET", "/index/1/4")
 
@@ -226,7 +278,8 @@ func TestCacheEmptyPath(t *testing.T) {
 		c.String(200, "empty")
 	})
 
-	redis.NewRedisMock()
+	Store = newTestStore()
+	defer func() { Store = NewRedisStore() }()
 
 	// Make request to empty path
 	resp := performRequest(router, "GET", "/")
@@ -252,43 +305,34 @@ func TestCircuitBreakerRecovery(t *testing.T) {
 
 	// Create a new circuit breaker with test config
 	CircuitBreaker = NewCircuitBreakerWithConfig(testConfig)
+	InMemoryCache = NewMemoryCache()
 
 	router := gin.New()
 	router.Use(Cache())
 
 	// Create a test handler that uses the cache middleware correctly
 	router.GET("/index/:ib/:page", func(c *gin.Context) {
-		// Set a shorter timeout for tests
-		c.Set("testTimeout", 50*time.Millisecond)
-
-		// For a cache miss, use the callback to return data
-		if _, ok := c.Get("cacheMiss"); ok {
-			if callback, ok := c.Get("setDataCallback"); ok {
-				callback.(func([]byte, error))([]byte("data from db"), nil)
-			}
-		}
-
 		// Return non-cached response
 		c.String(200, "not cached")
 	})
 
-	// Set up Redis mock
-	redis.NewRedisMock()
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
 
-	// 1. First, simulate Redis working properly
-	redis.Cache.Mock.Command("HGET", "index:1", "1").Expect("cached data")
+	// 1. First, simulate the store working properly
+	store.Set(CacheKey{Key: "index:1", Field: "1"}, []byte("cached data"), 0)
 	resp := performRequest(router, "GET", "/index/1/1")
 	assert.Equal(t, 200, resp.Code)
 	assert.Equal(t, "cached data", resp.Body.String())
 	assert.Equal(t, StateClosed, CircuitBreaker.State())
 
-	// 2. Now simulate Redis failures to trigger circuit open
-	redis.Cache.Mock.Command("HGET", "index:1", "2").ExpectError(errors.New("Redis connection error"))
+	// 2. Now simulate store failures to trigger circuit open
+	store.fail(errors.New("Redis connection error"), nil)
 	resp = performRequest(router, "GET", "/index/1/2")
 	assert.Equal(t, 200, resp.Code)
 	assert.Equal(t, "not cached", resp.Body.String())
 
-	redis.Cache.Mock.Command("HGET", "index:1", "2").ExpectError(errors.New("Redis connection error"))
 	resp = performRequest(router, "GET", "/index/1/2")
 	assert.Equal(t, 200, resp.Code)
 	assert.Equal(t, "not cached", resp.Body.String())
@@ -296,17 +340,19 @@ func TestCircuitBreakerRecovery(t *testing.T) {
 	// Circuit should now be open
 	assert.Equal(t, StateOpen, CircuitBreaker.State())
 
-	// 3. Make more requests - they should bypass Redis completely when circuit is open
+	// 3. Make more requests - they should bypass the store completely when circuit is open
+	gets := store.gets.Load()
 	resp = performRequest(router, "GET", "/index/1/3")
 	assert.Equal(t, 200, resp.Code)
 	assert.Equal(t, "not cached", resp.Body.String())
+	assert.Equal(t, gets, store.gets.Load(), "Store should not be called while the circuit is open")
 
 	// 4. Wait for reset timeout to allow half-open state
 	time.Sleep(20 * time.Millisecond)
 
 	// 5. Test half-open failure and back to open state
-	// Simulate Redis still being down when the circuit first tries half-open
-	redis.Cache.Mock.Command("HGET", "index:1", "4").ExpectError(errors.New("Redis still down"))
+	// Simulate the store still being down when the circuit first tries half-open
+	store.fail(errors.New("Redis still down"), nil)
 
 	resp = performRequest(router, "GET", "/index/1/4")
 	assert.Equal(t, 200, resp.Code)
@@ -317,9 +363,8 @@ func TestCircuitBreakerRecovery(t *testing.T) {
 	// Wait for another reset timeout period
 	time.Sleep(20 * time.Millisecond)
 
-	// 6. Now simulate Redis working again - this should allow recovery
-	redis.Cache.Mock.Command("HGET", "index:1", "5").Expect(nil) // Cache miss
-	redis.Cache.Mock.Command("HMSET", "index:1", "5", []byte("data from db")).Expect("OK")
+	// 6. Now simulate the store working again - this should allow recovery
+	store.fail(nil, nil)
 
 	resp = performRequest(router, "GET", "/index/1/5")
 	assert.Equal(t, 200, resp.Code)
@@ -330,12 +375,688 @@ func TestCircuitBreakerRecovery(t *testing.T) {
 	// Directly record a success to ensure circuit closes
 	CircuitBreaker.RecordSuccess()
 
-	// Circuit should now be closed again after the successful Redis operations
+	// Circuit should now be closed again after the successful store operations
 	assert.Equal(t, StateClosed, CircuitBreaker.State())
 
-	// 7. Final verification - Redis should be used normally again
-	redis.Cache.Mock.Command("HGET", "index:1", "6").Expect("cached again")
+	// 7. Final verification - the store should be used normally again
+	store.Set(CacheKey{Key: "index:1", Field: "6"}, []byte("cached again"), 0)
 	resp = performRequest(router, "GET", "/index/1/6")
 	assert.Equal(t, 200, resp.Code)
 	assert.Equal(t, "cached again", resp.Body.String())
 }
+
+// TestCacheEntryEncoding tests that entries survive a round trip and that raw
+// bodies written by older versions are read back as legacy entries
+func TestCacheEntryEncoding(t *testing.T) {
+	stored := time.Now().Add(-time.Minute)
+
+	raw, err := encodeEntry(&cacheEntry{Stored: stored, Body: []byte(`{"a":1}`)})
+	assert.NoError(t, err, "An error was not expected")
+
+	entry := decodeEntry(raw)
+	assert.False(t, entry.legacy, "Entry should not be legacy")
+	assert.Equal(t, `{"a":1}`, string(entry.Body), "Body should match")
+	assert.True(t, stored.Equal(entry.Stored), "Stored time should match")
+	assert.True(t, entry.fresh(2*time.Minute), "Entry should be fresh")
+	assert.False(t, entry.fresh(30*time.Second), "Entry should be stale")
+
+	legacy := decodeEntry([]byte(`{"a":1}`))
+	assert.True(t, legacy.legacy, "Entry should be legacy")
+	assert.Equal(t, `{"a":1}`, string(legacy.Body), "Body should match")
+	assert.True(t, legacy.fresh(time.Nanosecond), "Legacy entries should always be fresh")
+
+	truncated := decodeEntry(raw[:len(entryMagic)+2])
+	assert.True(t, truncated.legacy, "Truncated entry should be legacy")
+}
+
+// TestCacheStaleWhileRevalidate tests that stale entries are served immediately
+// while a single background refresh rebuilds them
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	var calls atomic.Int32
+
+	router := gin.New()
+	router.Use(CacheWithConfig(CacheConfig{
+		FreshFor:    time.Minute,
+		FillTimeout: time.Second,
+	}))
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		calls.Add(1)
+		c.Data(200, "application/json", []byte(`{"fresh":true}`))
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	fresh, err := encodeEntry(&cacheEntry{Stored: time.Now(), Body: []byte(`{"fresh":false}`)})
+	assert.NoError(t, err, "An error was not expected")
+
+	stale, err := encodeEntry(&cacheEntry{Stored: time.Now().Add(-2 * time.Minute), Body: []byte(`{"stale":true}`)})
+	assert.NoError(t, err, "An error was not expected")
+
+	// a fresh entry is served without touching the controller
+	store.Set(CacheKey{Key: "index:1", Field: "1"}, fresh, 0)
+
+	resp := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, resp.Code, "HTTP request code should match")
+	assert.Equal(t, `{"fresh":false}`, resp.Body.String(), "Body should match")
+	assert.Equal(t, int32(0), calls.Load(), "Controller should not be called for a fresh entry")
+
+	// a stale entry is served as is and refreshed in the background
+	store.Set(CacheKey{Key: "index:1", Field: "2"}, stale, 0)
+	sets := store.sets.Load()
+
+	resp = performRequest(router, "GET", "/index/1/2")
+	assert.Equal(t, 200, resp.Code, "HTTP request code should match")
+	assert.Equal(t, `{"stale":true}`, resp.Body.String(), "Stale body should be served")
+
+	assert.Eventually(t, func() bool {
+		_, running := refreshing.Load("index:1:2")
+		return !running
+	}, time.Second, 5*time.Millisecond, "Refresh should finish")
+
+	assert.Equal(t, sets+1, store.sets.Load(), "Refresh should store the new entry")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should be called once by the refresh")
+}
+
+// TestMemoryCache tests expiry, size limits and LRU eviction of the memory cache
+func TestMemoryCache(t *testing.T) {
+	mc := NewMemoryCacheWithConfig(MemoryCacheConfig{
+		MaxSize:     3*memoryItemOverhead + 30,
+		MaxItemSize: memoryItemOverhead + 20,
+		TTL:         time.Minute,
+		RouteTTL: map[string]time.Duration{
+			"short": 10 * time.Millisecond,
+		},
+	})
+
+	_, ok := mc.Get("a")
+	assert.False(t, ok, "Empty cache should miss")
+
+	mc.Set("test", "a", &cacheEntry{Body: []byte("aaaaaaaa")})
+	mc.Set("test", "b", &cacheEntry{Body: []byte("bbbbbbbb")})
+
+	entry, ok := mc.Get("a")
+	assert.True(t, ok, "Item should be cached")
+	assert.Equal(t, "aaaaaaaa", string(entry.Body), "Body should match")
+
+	// items over the per item cap are not stored
+	mc.Set("test", "huge", &cacheEntry{Body: make([]byte, 64)})
+	_, ok = mc.Get("huge")
+	assert.False(t, ok, "Oversized item should not be cached")
+
+	// a third item goes over the total cap and evicts the least recently used
+	mc.Set("test", "c", &cacheEntry{Body: []byte("cccccccccccccccc")})
+
+	_, ok = mc.Get("b")
+	assert.False(t, ok, "Least recently used item should be evicted")
+	_, ok = mc.Get("a")
+	assert.True(t, ok, "Recently used item should be kept")
+	_, ok = mc.Get("c")
+	assert.True(t, ok, "New item should be cached")
+
+	// route TTLs expire items
+	mc.Set("short", "d", &cacheEntry{Body: []byte("d")})
+	time.Sleep(15 * time.Millisecond)
+	_, ok = mc.Get("d")
+	assert.False(t, ok, "Expired item should miss")
+
+	hits, misses := mc.Stats()
+	assert.Equal(t, uint64(3), hits, "Hits should match")
+	assert.Equal(t, uint64(4), misses, "Misses should match")
+
+	// a zero size disables the cache
+	disabled := NewMemoryCacheWithConfig(MemoryCacheConfig{})
+	disabled.Set("test", "a", &cacheEntry{Body: []byte("a")})
+	_, ok = disabled.Get("a")
+	assert.False(t, ok, "Disabled cache should miss")
+}
+
+// TestCacheMemoryTier tests that store hits fill the memory cache so the
+// next request does not go to the store
+func TestCacheMemoryTier(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	var memoryCached []bool
+
+	router := gin.New()
+
+	// read the context values once the cache is done, like the analytics middleware
+	router.Use(func(c *gin.Context) {
+		c.Next()
+		memoryCached = append(memoryCached, c.GetBool("memoryCached"))
+	})
+
+	router.Use(Cache())
+
+	router.GET("/tagtypes", func(c *gin.Context) {
+		c.String(200, "not cached")
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	store.Set(CacheKey{Key: "tagtypes"}, []byte(`{"tagtypes":[]}`), 0)
+
+	first := performRequest(router, "GET", "/tagtypes")
+	assert.Equal(t, 200, first.Code, "HTTP request code should match")
+	assert.Equal(t, `{"tagtypes":[]}`, first.Body.String(), "Body should match")
+
+	second := performRequest(router, "GET", "/tagtypes")
+	assert.Equal(t, 200, second.Code, "HTTP request code should match")
+	assert.Equal(t, `{"tagtypes":[]}`, second.Body.String(), "Body should match")
+
+	assert.Equal(t, int32(1), store.gets.Load(), "Store should only be hit once")
+
+	hits, misses := InMemoryCache.Stats()
+	assert.Equal(t, uint64(1), hits, "Hits should match")
+	assert.Equal(t, uint64(1), misses, "Misses should match")
+
+	assert.Equal(t, []bool{false, true}, memoryCached, "Only the second request should be a memory hit")
+}
+
+// performRequestWithHeaders is performRequest with extra request headers
+func performRequestWithHeaders(r http.Handler, method, path string, headers map[string]string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	req.Header.Set("X-Real-Ip", "123.0.0.1")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// TestCacheETag tests that cached and fresh responses carry an ETag and that a
+// matching If-None-Match gets a 304
+func TestCacheETag(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	router := gin.New()
+	router.Use(Cache())
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		output := []byte(`{"index":"fresh"}`)
+		c.Data(200, "application/json", output)
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	entry := newCacheEntry([]byte(`{"index":"cached"}`))
+	raw, err := encodeEntry(entry)
+	assert.NoError(t, err, "An error was not expected")
+
+	store.Set(CacheKey{Key: "index:1", Field: "1"}, raw, 0)
+
+	cached := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, cached.Code, "HTTP request code should match")
+	assert.Equal(t, entry.ETag, cached.Header().Get("ETag"), "ETag should match")
+
+	notModified := performRequestWithHeaders(router, "GET", "/index/1/1", map[string]string{
+		"If-None-Match": `"other", ` + entry.ETag,
+	})
+	assert.Equal(t, 304, notModified.Code, "HTTP request code should match")
+	assert.Empty(t, notModified.Body.String(), "Body should be empty")
+
+	modified := performRequestWithHeaders(router, "GET", "/index/1/1", map[string]string{
+		"If-None-Match": `"other"`,
+	})
+	assert.Equal(t, 200, modified.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"cached"}`, modified.Body.String(), "Body should match")
+
+	// a fresh response from the controller gets the same validator it is stored with
+	fresh := performRequest(router, "GET", "/index/1/2")
+	assert.Equal(t, 200, fresh.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"fresh"}`, fresh.Body.String(), "Body should match")
+	assert.Equal(t, computeETag([]byte(`{"index":"fresh"}`)), fresh.Header().Get("ETag"), "ETag should match")
+
+	// weak comparison and wildcards
+	assert.True(t, entry.notModified("W/"+entry.ETag, ""), "Weak tag should match")
+	assert.True(t, entry.notModified("*", ""), "Wildcard should match")
+	assert.False(t, entry.notModified("", ""), "Empty header should not match")
+}
+
+// TestCacheLastModified tests that Last-Modified is the time the cached body last changed
+// and that If-Modified-Since is honored
+func TestCacheLastModified(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	modified := time.Date(2024, 5, 1, 12, 30, 15, 500, time.UTC)
+
+	router := gin.New()
+	router.Use(CacheWithConfig(CacheConfig{
+		FreshFor:    time.Minute,
+		FillTimeout: time.Second,
+	}))
+
+	router.GET("/thread/:ib/:thread/:page", func(c *gin.Context) {
+		output := []byte(`{"thread":"cached"}`)
+		if c.Param("thread") == "4" {
+			output = []byte(`{"thread":"edited"}`)
+		}
+		c.Data(200, "application/json", output)
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	// a fill sends the time the entry was built
+	fresh := performRequest(router, "GET", "/thread/1/1/1")
+	assert.Equal(t, 200, fresh.Code, "HTTP request code should match")
+
+	built, err := http.ParseTime(fresh.Header().Get("Last-Modified"))
+	assert.NoError(t, err, "An error was not expected")
+	assert.WithinDuration(t, time.Now(), built, 2*time.Second, "Last-Modified should be the fill time")
+
+	// a cached entry sends the time its body last changed
+	entry := newCacheEntry([]byte(`{"thread":"cached"}`))
+	entry.Modified = modified
+	raw, err := encodeEntry(entry)
+	assert.NoError(t, err, "An error was not expected")
+
+	store.Set(CacheKey{Key: "thread:1:2", Field: "1"}, raw, 0)
+
+	unchanged := performRequestWithHeaders(router, "GET", "/thread/1/2/1", map[string]string{
+		"If-Modified-Since": "Wed, 01 May 2024 12:30:15 GMT",
+	})
+	assert.Equal(t, 304, unchanged.Code, "HTTP request code should match")
+	assert.Equal(t, "Wed, 01 May 2024 12:30:15 GMT", unchanged.Header().Get("Last-Modified"), "Last-Modified should match")
+
+	changed := performRequestWithHeaders(router, "GET", "/thread/1/2/1", map[string]string{
+		"If-Modified-Since": "Wed, 01 May 2024 12:30:14 GMT",
+	})
+	assert.Equal(t, 200, changed.Code, "HTTP request code should match")
+	assert.Equal(t, `{"thread":"cached"}`, changed.Body.String(), "Body should match")
+
+	// If-None-Match wins over If-Modified-Since
+	mismatch := performRequestWithHeaders(router, "GET", "/thread/1/2/1", map[string]string{
+		"If-None-Match":     `"other"`,
+		"If-Modified-Since": "Wed, 01 May 2024 12:30:15 GMT",
+	})
+	assert.Equal(t, 200, mismatch.Code, "HTTP request code should match")
+
+	// a refresh that builds the same body keeps the time, one that builds a
+	// different body moves it
+	for _, tt := range []struct {
+		thread string
+		moved  bool
+	}{
+		{"3", false},
+		{"4", true},
+	} {
+		stale := newCacheEntry([]byte(`{"thread":"cached"}`))
+		stale.Stored = time.Now().Add(-2 * time.Minute)
+		stale.Modified = modified
+		raw, err = encodeEntry(stale)
+		assert.NoError(t, err, "An error was not expected")
+
+		key := CacheKey{Key: "thread:1:" + tt.thread, Field: "1"}
+		store.Set(key, raw, 0)
+
+		resp := performRequest(router, "GET", "/thread/1/"+tt.thread+"/1")
+		assert.Equal(t, 200, resp.Code, "HTTP request code should match")
+
+		assert.Eventually(t, func() bool {
+			_, running := refreshing.Load("thread:1:" + tt.thread + ":1")
+			return !running
+		}, time.Second, 5*time.Millisecond, "Refresh should finish")
+
+		raw, err = store.Get(key)
+		assert.NoError(t, err, "An error was not expected")
+
+		refreshed := decodeEntry(raw)
+		assert.True(t, refreshed.Stored.After(stale.Stored), "Refresh should store a new entry")
+		if tt.moved {
+			assert.WithinDuration(t, time.Now(), refreshed.Modified, 2*time.Second, "Changed body should move Last-Modified")
+		} else {
+			assert.True(t, modified.Equal(refreshed.Modified), "Unchanged body should keep Last-Modified")
+		}
+	}
+}
+
+// TestCacheSharedFill tests that requests waiting on the same cache miss all get the
+// response from the single controller run, errors included, and that the request
+// which started the fill going away does not fail the others
+func TestCacheSharedFill(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	var calls atomic.Int32
+	var once sync.Once
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	config := DefaultCacheConfig
+	config.Diagnostics = true
+
+	router := gin.New()
+	router.Use(CacheWithConfig(config))
+
+	router.GET("/thread/:ib/:thread/:page", func(c *gin.Context) {
+		calls.Add(1)
+		once.Do(func() { close(started) })
+		<-release
+		c.Set("controllerError", true)
+		c.JSON(http.StatusInternalServerError, gin.H{"error_message": "Internal error"})
+	})
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		<-release
+		if c.Request.Context().Err() != nil {
+			c.String(http.StatusInternalServerError, "cancelled")
+			return
+		}
+		c.Data(http.StatusOK, "application/json", []byte(`{"index":"fresh"}`))
+	})
+
+	router.GET("/image/:ib/:id", func(c *gin.Context) {
+		panic("controller exploded")
+	})
+
+	Store = newTestStore()
+	defer func() { Store = NewRedisStore() }()
+
+	// every waiting request gets the same error response
+	responses := make([]*httptest.ResponseRecorder, 3)
+
+	var wg sync.WaitGroup
+
+	for i := range responses {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i] = performRequest(router, "GET", "/thread/1/1/1")
+		}()
+
+		if i == 0 {
+			<-started
+		}
+	}
+
+	// give the followers time to join the fill before it finishes
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), calls.Load(), "Controller should run once")
+
+	results := map[string]int{}
+
+	for _, response := range responses {
+		assert.Equal(t, 500, response.Code, "HTTP request code should match")
+		assert.JSONEq(t, `{"error_message":"Internal error"}`, response.Body.String(), "Body should match")
+		results[response.Header().Get("X-Cache")]++
+	}
+
+	assert.Equal(t, map[string]int{"MISS": 1, "SHARED": 2}, results, "Only one request should run the controller")
+
+	_, cached := InMemoryCache.Get("thread:1:1:1")
+	assert.False(t, cached, "Error responses should not be cached")
+
+	// the fill is not tied to the request that started it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/index/1/1", nil)
+	cancelled := httptest.NewRecorder()
+	router.ServeHTTP(cancelled, req)
+
+	assert.Equal(t, 200, cancelled.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"fresh"}`, cancelled.Body.String(), "Body should match")
+
+	_, cached = InMemoryCache.Get("index:1:1")
+	assert.True(t, cached, "Response should be cached")
+
+	// a panicking controller becomes an internal error
+	panicked := performRequest(router, "GET", "/image/1/1")
+
+	assert.Equal(t, 500, panicked.Code, "HTTP request code should match")
+}
+
+// TestCacheNotFound tests that not found responses are cached with a short expiry
+// and replayed with their status, and are overwritten once the resource exists
+func TestCacheNotFound(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	var calls atomic.Int32
+	var exists atomic.Bool
+
+	router := gin.New()
+	router.Use(CacheWithConfig(CacheConfig{
+		FreshFor:    time.Minute,
+		FillTimeout: time.Second,
+		NotFoundTTL: 30 * time.Second,
+	}))
+
+	router.GET("/thread/:ib/:thread/:page", func(c *gin.Context) {
+		calls.Add(1)
+		if !exists.Load() {
+			c.Set("controllerError", true)
+			c.JSON(http.StatusNotFound, gin.H{"error_message": "Request not found"})
+			return
+		}
+		c.Data(http.StatusOK, "application/json", []byte(`{"thread":"found"}`))
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	key := CacheKey{Key: "thread:1:999999", Field: "1"}
+
+	first := performRequest(router, "GET", "/thread/1/999999/1")
+	assert.Equal(t, 404, first.Code, "HTTP request code should match")
+
+	stored := store.keys[key.Key][key.Field]
+	assert.NotEmpty(t, stored.data, "Entry should be stored")
+	assert.WithinDuration(t, time.Now().Add(30*time.Second), stored.expires, time.Second, "Entry should expire with the not found ttl")
+
+	// the second request is replayed from the cache with the same status
+	second := performRequest(router, "GET", "/thread/1/999999/1")
+	assert.Equal(t, 404, second.Code, "HTTP request code should match")
+	assert.JSONEq(t, `{"error_message":"Request not found"}`, second.Body.String(), "Body should match")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should run once")
+
+	// once the negative entry expires the next request overwrites it
+	entry, ok := InMemoryCache.Get("thread:1:999999:1")
+	assert.True(t, ok, "Entry should be in memory")
+	assert.Equal(t, 404, entry.status(), "Status should be stored")
+
+	expired := *entry
+	expired.Expires = time.Now().Add(-time.Second)
+	raw, err := encodeEntry(&expired)
+	assert.NoError(t, err, "An error was not expected")
+
+	InMemoryCache = NewMemoryCache()
+	exists.Store(true)
+
+	store.Set(key, raw, 0)
+
+	found := performRequest(router, "GET", "/thread/1/999999/1")
+	assert.Equal(t, 200, found.Code, "HTTP request code should match")
+	assert.Equal(t, `{"thread":"found"}`, found.Body.String(), "Body should match")
+	assert.Equal(t, int32(2), calls.Load(), "Controller should run again")
+
+	entry, ok = InMemoryCache.Get("thread:1:999999:1")
+	assert.True(t, ok, "Entry should be in memory")
+	assert.Equal(t, 200, entry.status(), "Entry should be overwritten")
+	assert.True(t, entry.Expires.IsZero(), "Entry should not expire")
+
+	// other errors are never cached
+	server := newCacheEntry([]byte(`{"error_message":"Internal error"}`))
+	server.Status = http.StatusInternalServerError
+	server.Expires = time.Now().Add(time.Minute)
+	assert.False(t, server.cacheable(), "Server errors should not be cacheable")
+}
+
+// TestCacheEarlyRefresh tests that slow entries close to going stale are refreshed
+// ahead of time while cheap or new entries are left alone
+func TestCacheEarlyRefresh(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	slow := &cacheEntry{Stored: time.Now().Add(-50 * time.Second), Delta: time.Hour, Body: []byte(`{"slow":true}`)}
+	cheap := &cacheEntry{Stored: time.Now().Add(-50 * time.Second), Delta: time.Nanosecond, Body: []byte(`{"cheap":true}`)}
+	unknown := &cacheEntry{Stored: time.Now().Add(-50 * time.Second), Body: []byte(`{"unknown":true}`)}
+
+	assert.True(t, slow.earlyRefresh(time.Minute, 1), "Slow entry should be refreshed early")
+	assert.False(t, slow.earlyRefresh(time.Minute, 0), "Early refresh should be disabled")
+	assert.False(t, cheap.earlyRefresh(time.Minute, 1), "Cheap entry should not be refreshed early")
+	assert.False(t, unknown.earlyRefresh(time.Minute, 1), "Entry without a fill time should not be refreshed early")
+	assert.False(t, legacyEntry([]byte(`{}`)).earlyRefresh(time.Minute, 1), "Legacy entry should not be refreshed early")
+
+	var calls atomic.Int32
+
+	router := gin.New()
+	router.Use(CacheWithConfig(CacheConfig{
+		FreshFor:         time.Minute,
+		FillTimeout:      time.Second,
+		EarlyRefreshBeta: 1,
+	}))
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		calls.Add(1)
+		c.Data(200, "application/json", []byte(`{"fresh":true}`))
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	raw, err := encodeEntry(slow)
+	assert.NoError(t, err, "An error was not expected")
+
+	store.Set(CacheKey{Key: "index:1", Field: "1"}, raw, 0)
+	sets := store.sets.Load()
+
+	// the entry is still fresh so it is served, and rebuilt in the background
+	resp := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, resp.Code, "HTTP request code should match")
+	assert.Equal(t, `{"slow":true}`, resp.Body.String(), "Cached body should be served")
+
+	assert.Eventually(t, func() bool {
+		_, running := refreshing.Load("index:1:1")
+		return !running
+	}, time.Second, 5*time.Millisecond, "Refresh should finish")
+
+	assert.Equal(t, sets+1, store.sets.Load(), "Refresh should store the new entry")
+	assert.Equal(t, int32(1), calls.Load(), "Controller should be called once by the refresh")
+
+	// the refreshed entry records how long the fill took
+	entry, ok := InMemoryCache.Get("index:1:1")
+	assert.True(t, ok, "Entry should be in memory")
+	assert.Positive(t, entry.Delta, "Fill time should be recorded")
+	assert.Equal(t, `{"fresh":true}`, string(entry.Body), "Entry should be refreshed")
+}
+
+// TestCacheDiagnostics tests the X-Cache headers for each way a request is handled
+func TestCacheDiagnostics(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	config := DefaultCacheConfig
+	config.Diagnostics = true
+
+	router := gin.New()
+	router.Use(CacheWithConfig(config))
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		c.Data(200, "application/json", []byte(`{"index":"fresh"}`))
+	})
+
+	router.GET("/nocache/:id", func(c *gin.Context) {
+		c.String(200, "OK")
+	})
+
+	store := newTestStore()
+	Store = store
+	defer func() { Store = NewRedisStore() }()
+
+	miss := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, "MISS", miss.Header().Get("X-Cache"), "X-Cache should match")
+	assert.Equal(t, "index:1", miss.Header().Get("X-Cache-Key"), "X-Cache-Key should match")
+	assert.Equal(t, "1", miss.Header().Get("X-Cache-Field"), "X-Cache-Field should match")
+	assert.Empty(t, miss.Header().Get("X-Cache-Age"), "X-Cache-Age should not be set")
+
+	hit := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, "HIT", hit.Header().Get("X-Cache"), "X-Cache should match")
+	assert.Equal(t, "index:1", hit.Header().Get("X-Cache-Key"), "X-Cache-Key should match")
+	assert.Equal(t, "1", hit.Header().Get("X-Cache-Field"), "X-Cache-Field should match")
+	assert.Equal(t, "0", hit.Header().Get("X-Cache-Age"), "X-Cache-Age should match")
+
+	old, err := encodeEntry(&cacheEntry{Stored: time.Now().Add(-30 * time.Second), Body: []byte(`{"index":"old"}`)})
+	assert.NoError(t, err, "An error was not expected")
+
+	store.Set(CacheKey{Key: "index:1", Field: "2"}, old, 0)
+
+	aged := performRequest(router, "GET", "/index/1/2")
+	assert.Equal(t, "HIT", aged.Header().Get("X-Cache"), "X-Cache should match")
+	assert.Equal(t, "30", aged.Header().Get("X-Cache-Age"), "X-Cache-Age should match")
+
+	bypass := performRequest(router, "GET", "/nocache/1")
+	assert.Equal(t, "BYPASS", bypass.Header().Get("X-Cache"), "X-Cache should match")
+	assert.Empty(t, bypass.Header().Get("X-Cache-Key"), "X-Cache-Key should not be set")
+
+	// query parameters are part of the field
+	posts := performRequest(router, "GET", "/index/1/3?posts=3")
+	assert.Equal(t, "index:1", posts.Header().Get("X-Cache-Key"), "X-Cache-Key should match")
+	assert.Equal(t, "3?posts=3", posts.Header().Get("X-Cache-Field"), "X-Cache-Field should match")
+
+	query := performRequest(router, "GET", "/index/1/3?what=2")
+	assert.Equal(t, "BYPASS", query.Header().Get("X-Cache"), "X-Cache should match")
+
+	// the open breaker sends requests straight to the controller
+	CircuitBreaker = NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    1,
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+	})
+	CircuitBreaker.RecordFailure()
+
+	breaker := performRequest(router, "GET", "/index/1/4")
+	assert.Equal(t, "BREAKER", breaker.Header().Get("X-Cache"), "X-Cache should match")
+	assert.Equal(t, "index:1", breaker.Header().Get("X-Cache-Key"), "X-Cache-Key should match")
+	assert.Equal(t, "4", breaker.Header().Get("X-Cache-Field"), "X-Cache-Field should match")
+
+	// the headers are off by default
+	CircuitBreaker = NewCircuitBreaker()
+
+	quiet := gin.New()
+	quiet.Use(Cache())
+	quiet.GET("/index/:ib/:page", func(c *gin.Context) {
+		c.Data(200, "application/json", []byte(`{"index":"fresh"}`))
+	})
+
+	off := performRequest(quiet, "GET", "/index/1/1")
+	assert.Equal(t, 200, off.Code, "HTTP request code should match")
+	assert.Empty(t, off.Header().Get("X-Cache"), "X-Cache should not be set")
+}
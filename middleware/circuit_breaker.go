@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -20,6 +21,61 @@ const (
 	StateTest CircuitBreakerState = 99
 )
 
+// String returns the name of the state
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText writes the state by name in JSON
+func (s CircuitBreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// circuitBreakerHistory is how many state changes a circuit breaker remembers
+const circuitBreakerHistory = 20
+
+// CircuitBreakerTransition is a state change of a circuit breaker
+type CircuitBreakerTransition struct {
+	From CircuitBreakerState `json:"from"`
+	To   CircuitBreakerState `json:"to"`
+	Time time.Time           `json:"time"`
+	// Forced is set when an operator changed the state
+	Forced bool `json:"forced"`
+}
+
+// CircuitBreakerStats is a snapshot of a circuit breaker for operators
+type CircuitBreakerStats struct {
+	State           CircuitBreakerState        `json:"state"`
+	Forced          bool                       `json:"forced"`
+	Failures        uint32                     `json:"failures"`
+	TotalSuccesses  uint64                     `json:"total_successes"`
+	TotalFailures   uint64                     `json:"total_failures"`
+	WindowRequests  uint32                     `json:"window_requests,omitempty"`
+	WindowFailures  uint32                     `json:"window_failures,omitempty"`
+	LastStateChange time.Time                  `json:"last_state_change"`
+	History         []CircuitBreakerTransition `json:"history"`
+}
+
+// CircuitBreakerMode selects how the circuit breaker decides to open
+type CircuitBreakerMode uint32
+
+const (
+	// ModeConsecutive opens the circuit after FailureThreshold failures in a row
+	ModeConsecutive CircuitBreakerMode = iota
+	// ModeFailureRate opens the circuit when the share of failed or slow calls in
+	// the sliding window reaches FailureRate
+	ModeFailureRate
+)
+
 // CircuitBreakerConfig holds the configuration for the circuit breaker
 type CircuitBreakerConfig struct {
 	// FailureThreshold is the number of consecutive failures required to open the circuit
@@ -28,6 +84,21 @@ type CircuitBreakerConfig struct {
 	ResetTimeout time.Duration
 	// HalfOpenMaxRequests is the number of requests allowed through when half-open
 	HalfOpenMaxRequests uint32
+	// Mode selects consecutive failures or the failure rate, the settings below are
+	// only used by the failure rate mode
+	Mode CircuitBreakerMode
+	// Window is how far back the failure rate looks
+	Window time.Duration
+	// WindowBuckets is how many buckets the window is split into, calls age out
+	// of the window one bucket at a time
+	WindowBuckets uint32
+	// FailureRate is the share of failed calls between 0 and 1 that opens the circuit
+	FailureRate float64
+	// MinimumRequests is how many calls the window needs before the rate counts
+	MinimumRequests uint32
+	// SlowCallThreshold is how long a successful call may take before it counts
+	// as a failure, zero disables it
+	SlowCallThreshold time.Duration
 }
 
 // DefaultCircuitBreakerConfig provides sensible defaults for the circuit breaker
@@ -35,6 +106,12 @@ var DefaultCircuitBreakerConfig = CircuitBreakerConfig{
 	FailureThreshold:    5,
 	ResetTimeout:        10 * time.Second,
 	HalfOpenMaxRequests: 3,
+	Mode:                ModeConsecutive,
+	Window:              10 * time.Second,
+	WindowBuckets:       10,
+	FailureRate:         0.5,
+	MinimumRequests:     20,
+	SlowCallThreshold:   500 * time.Millisecond,
 }
 
 // CacheCircuitBreaker implements a simple circuit breaker pattern for Redis cache
@@ -45,6 +122,20 @@ type CacheCircuitBreaker struct {
 	failures        uint32
 	lastStateChange time.Time
 	halfOpenCount   uint32
+	window          []windowBucket
+	forced          uint32
+	successTotal    uint64
+	failureTotal    uint64
+	history         []CircuitBreakerTransition
+}
+
+// windowBucket counts the calls of one slice of the sliding window
+type windowBucket struct {
+	// slot is the bucket's position counted from the epoch, a bucket whose slot
+	// is behind the current one holds old calls
+	slot      int64
+	successes uint32
+	failures  uint32
 }
 
 // NewCircuitBreaker creates a new circuit breaker with default configuration
@@ -54,12 +145,26 @@ func NewCircuitBreaker() *CacheCircuitBreaker {
 
 // NewCircuitBreakerWithConfig creates a new circuit breaker with the given configuration
 func NewCircuitBreakerWithConfig(config CircuitBreakerConfig) *CacheCircuitBreaker {
-	return &CacheCircuitBreaker{
+	cb := &CacheCircuitBreaker{
 		state:           uint32(StateClosed),
 		config:          config,
 		failures:        0,
 		lastStateChange: time.Now(),
 	}
+
+	if config.Mode == ModeFailureRate {
+		if cb.config.Window <= 0 {
+			cb.config.Window = DefaultCircuitBreakerConfig.Window
+		}
+
+		if cb.config.WindowBuckets == 0 {
+			cb.config.WindowBuckets = DefaultCircuitBreakerConfig.WindowBuckets
+		}
+
+		cb.window = make([]windowBucket, cb.config.WindowBuckets)
+	}
+
+	return cb
 }
 
 // State returns the current state of the circuit breaker
@@ -76,6 +181,16 @@ func (cb *CacheCircuitBreaker) RecordSuccess() {
 
 	// Reset failure counter on success
 	cb.failures = 0
+	cb.successTotal++
+
+	// A forced state only changes when an operator releases it
+	if cb.isForced() {
+		return
+	}
+
+	if cb.window != nil && state == StateClosed {
+		cb.bucket(time.Now()).successes++
+	}
 
 	// If we're half-open or open and get a success, close the circuit
 	// This ensures we can recover even if state transition was missed
@@ -94,9 +209,24 @@ func (cb *CacheCircuitBreaker) RecordFailure() {
 	// Increment failure counter
 	newFailures := cb.failures + 1
 	cb.failures = newFailures
+	cb.failureTotal++
+
+	// A forced state only changes when an operator releases it
+	if cb.isForced() {
+		return
+	}
+
+	if cb.window != nil {
+		// Open circuit if the failure rate hits the threshold and circuit is currently closed
+		if state == StateClosed {
+			cb.bucket(time.Now()).failures++
 
-	// Open circuit if we hit the threshold and circuit is currently closed
-	if state == StateClosed && newFailures >= cb.config.FailureThreshold {
+			if cb.failureRateExceeded(time.Now()) {
+				cb.changeState(StateOpen)
+			}
+		}
+	} else if state == StateClosed && newFailures >= cb.config.FailureThreshold {
+		// Open circuit if we hit the threshold and circuit is currently closed
 		cb.changeState(StateOpen)
 	}
 
@@ -107,10 +237,157 @@ func (cb *CacheCircuitBreaker) RecordFailure() {
 	}
 }
 
+// RetryAfter returns how long an open circuit stays open before letting a test request through
+func (cb *CacheCircuitBreaker) RetryAfter() time.Duration {
+	if cb.State() != StateOpen {
+		return 0
+	}
+
+	cb.mutex.RLock()
+	elapsed := time.Since(cb.lastStateChange)
+	cb.mutex.RUnlock()
+
+	return max(0, cb.config.ResetTimeout-elapsed)
+}
+
+// RecordDuration records a Redis operation that succeeded after elapsed, in
+// failure rate mode calls slower than SlowCallThreshold count as failures
+func (cb *CacheCircuitBreaker) RecordDuration(elapsed time.Duration) {
+	if cb.window != nil && cb.config.SlowCallThreshold > 0 && elapsed > cb.config.SlowCallThreshold {
+		cb.RecordFailure()
+		return
+	}
+
+	cb.RecordSuccess()
+}
+
+// RecordMiss records a lookup that reached Redis and found nothing. In failure
+// rate mode it counts toward the window like any other call, but a miss does
+// not reset the consecutive failures or close the circuit.
+func (cb *CacheCircuitBreaker) RecordMiss(elapsed time.Duration) {
+	if cb.window == nil || cb.State() != StateClosed || cb.isForced() {
+		return
+	}
+
+	if cb.config.SlowCallThreshold > 0 && elapsed > cb.config.SlowCallThreshold {
+		cb.RecordFailure()
+		return
+	}
+
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	cb.bucket(time.Now()).successes++
+}
+
+// bucket returns the window bucket for a time, clearing it if it holds calls
+// from an earlier pass around the window. The caller must hold the lock.
+func (cb *CacheCircuitBreaker) bucket(now time.Time) *windowBucket {
+	slot := cb.slot(now)
+
+	bucket := &cb.window[slot%int64(len(cb.window))]
+	if bucket.slot != slot {
+		*bucket = windowBucket{slot: slot}
+	}
+
+	return bucket
+}
+
+// slot returns the position of the bucket a time falls in
+func (cb *CacheCircuitBreaker) slot(now time.Time) int64 {
+	return now.UnixNano() / int64(cb.config.Window/time.Duration(len(cb.window)))
+}
+
+// failureRateExceeded reports whether the calls in the window fail often enough
+// to open the circuit. The caller must hold the lock.
+func (cb *CacheCircuitBreaker) failureRateExceeded(now time.Time) bool {
+	oldest := cb.slot(now) - int64(len(cb.window))
+
+	var successes, failures uint32
+
+	for _, bucket := range cb.window {
+		if bucket.slot > oldest {
+			successes += bucket.successes
+			failures += bucket.failures
+		}
+	}
+
+	total := successes + failures
+
+	return total > 0 && total >= cb.config.MinimumRequests && float64(failures)/float64(total) >= cb.config.FailureRate
+}
+
+// Force holds the circuit open or closed until Release is called, for example
+// to keep requests off Redis during maintenance
+func (cb *CacheCircuitBreaker) Force(state CircuitBreakerState) {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	atomic.StoreUint32(&cb.forced, 1)
+	cb.failures = 0
+
+	cb.transition(state, true)
+}
+
+// Release hands a forced circuit back to the breaker, it starts out closed
+func (cb *CacheCircuitBreaker) Release() {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	if !cb.isForced() {
+		return
+	}
+
+	atomic.StoreUint32(&cb.forced, 0)
+	cb.failures = 0
+	clear(cb.window)
+
+	cb.transition(StateClosed, true)
+}
+
+// isForced reports whether an operator holds the circuit in its state
+func (cb *CacheCircuitBreaker) isForced() bool {
+	return atomic.LoadUint32(&cb.forced) == 1
+}
+
+// Stats returns a snapshot of the circuit breaker
+func (cb *CacheCircuitBreaker) Stats() CircuitBreakerStats {
+	cb.mutex.RLock()
+	defer cb.mutex.RUnlock()
+
+	stats := CircuitBreakerStats{
+		State:           cb.State(),
+		Forced:          cb.isForced(),
+		Failures:        cb.failures,
+		TotalSuccesses:  cb.successTotal,
+		TotalFailures:   cb.failureTotal,
+		LastStateChange: cb.lastStateChange,
+		History:         slices.Clone(cb.history),
+	}
+
+	if cb.window != nil {
+		oldest := cb.slot(time.Now()) - int64(len(cb.window))
+
+		for _, bucket := range cb.window {
+			if bucket.slot > oldest {
+				stats.WindowRequests += bucket.successes + bucket.failures
+				stats.WindowFailures += bucket.failures
+			}
+		}
+	}
+
+	return stats
+}
+
 // AllowRequest checks if a request should use Redis cache or bypass it
 func (cb *CacheCircuitBreaker) AllowRequest() bool {
 	state := cb.State()
 
+	// A forced circuit lets everything or nothing through
+	if cb.isForced() {
+		return state != StateOpen
+	}
+
 	switch state {
 	case StateClosed:
 		// When closed, all requests go through the normal caching flow
@@ -151,11 +428,36 @@ func (cb *CacheCircuitBreaker) AllowRequest() bool {
 
 // changeState changes the state of the circuit breaker
 func (cb *CacheCircuitBreaker) changeState(newState CircuitBreakerState) {
+	cb.transition(newState, false)
+}
+
+// transition changes the state and records it in the history
+func (cb *CacheCircuitBreaker) transition(newState CircuitBreakerState, forced bool) {
+	oldState := cb.State()
+
 	atomic.StoreUint32(&cb.state, uint32(newState))
 	cb.lastStateChange = time.Now()
 
+	if oldState != newState || forced {
+		cb.history = append(cb.history, CircuitBreakerTransition{
+			From:   oldState,
+			To:     newState,
+			Time:   cb.lastStateChange,
+			Forced: forced,
+		})
+
+		if len(cb.history) > circuitBreakerHistory {
+			cb.history = slices.Delete(cb.history, 0, len(cb.history)-circuitBreakerHistory)
+		}
+	}
+
 	// Reset half-open counter when changing state
 	if newState == StateHalfOpen {
 		atomic.StoreUint32(&cb.halfOpenCount, 0)
 	}
+
+	// The window starts over once the circuit closes again
+	if newState == StateOpen {
+		clear(cb.window)
+	}
 }
@@ -0,0 +1,182 @@
+package middleware
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestFailureRateBreaker tests that a flaky Redis opens the circuit in failure
+// rate mode even though its failures are never consecutive
+func TestFailureRateBreaker(t *testing.T) {
+	config := CircuitBreakerConfig{
+		ResetTimeout:        10 * time.Millisecond,
+		HalfOpenMaxRequests: 1,
+		Mode:                ModeFailureRate,
+		Window:              time.Minute,
+		WindowBuckets:       6,
+		FailureRate:         0.5,
+		MinimumRequests:     10,
+	}
+
+	cb := NewCircuitBreakerWithConfig(config)
+
+	// half the calls fail but there are not enough calls to judge yet
+	for range 4 {
+		cb.RecordSuccess()
+		cb.RecordFailure()
+	}
+	assert.Equal(t, StateClosed, cb.State(), "State should be Closed under the minimum requests")
+
+	cb.RecordSuccess()
+	cb.RecordFailure()
+	assert.Equal(t, StateOpen, cb.State(), "State should be Open at the failure rate")
+
+	// the consecutive mode never opens for the same calls
+	consecutive := NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    2,
+		ResetTimeout:        10 * time.Millisecond,
+		HalfOpenMaxRequests: 1,
+	})
+
+	for range 10 {
+		consecutive.RecordSuccess()
+		consecutive.RecordFailure()
+	}
+	assert.Equal(t, StateClosed, consecutive.State(), "State should be Closed")
+
+	// recovery works like the consecutive mode and starts a new window
+	time.Sleep(15 * time.Millisecond)
+	assert.True(t, cb.AllowRequest(), "Request should be allowed in Half-Open state")
+	cb.RecordSuccess()
+	assert.Equal(t, StateClosed, cb.State(), "State should be Closed after success in Half-Open state")
+
+	for range 4 {
+		cb.RecordFailure()
+	}
+	assert.Equal(t, StateClosed, cb.State(), "Window should start over after the circuit closes")
+
+	// misses count toward the rate without closing anything
+	for range 6 {
+		cb.RecordMiss(time.Millisecond)
+	}
+	assert.Equal(t, StateClosed, cb.State(), "State should be Closed under the failure rate")
+}
+
+// TestFailureRateBreakerSlowCalls tests that slow calls count as failures
+func TestFailureRateBreakerSlowCalls(t *testing.T) {
+	config := CircuitBreakerConfig{
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+		Mode:                ModeFailureRate,
+		FailureRate:         0.5,
+		MinimumRequests:     4,
+		SlowCallThreshold:   100 * time.Millisecond,
+	}
+
+	cb := NewCircuitBreakerWithConfig(config)
+
+	cb.RecordDuration(time.Millisecond)
+	cb.RecordDuration(time.Millisecond)
+	cb.RecordDuration(time.Second)
+	assert.Equal(t, StateClosed, cb.State(), "State should be Closed under the minimum requests")
+
+	cb.RecordMiss(time.Second)
+	assert.Equal(t, StateOpen, cb.State(), "State should be Open with slow calls")
+
+	// slow calls are successes in the consecutive mode
+	consecutive := NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    1,
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+		SlowCallThreshold:   100 * time.Millisecond,
+	})
+
+	consecutive.RecordDuration(time.Second)
+	consecutive.RecordMiss(time.Second)
+	assert.Equal(t, StateClosed, consecutive.State(), "State should be Closed")
+}
+
+// TestFailureRateBreakerWindow tests that old calls age out of the window
+func TestFailureRateBreakerWindow(t *testing.T) {
+	config := CircuitBreakerConfig{
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+		Mode:                ModeFailureRate,
+		Window:              40 * time.Millisecond,
+		WindowBuckets:       4,
+		FailureRate:         0.5,
+		MinimumRequests:     4,
+	}
+
+	cb := NewCircuitBreakerWithConfig(config)
+
+	for range 3 {
+		cb.RecordFailure()
+	}
+
+	// the failures are gone once the window has passed
+	time.Sleep(50 * time.Millisecond)
+
+	cb.RecordFailure()
+	assert.Equal(t, StateClosed, cb.State(), "Old failures should not count")
+}
+
+// TestForcedBreaker tests that operators can hold the circuit in a state
+func TestForcedBreaker(t *testing.T) {
+	cb := NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    1,
+		ResetTimeout:        10 * time.Millisecond,
+		HalfOpenMaxRequests: 1,
+	})
+
+	// forced open stays open past the reset timeout and through successes
+	cb.Force(StateOpen)
+	assert.Equal(t, StateOpen, cb.State(), "State should be Open")
+
+	time.Sleep(15 * time.Millisecond)
+	assert.False(t, cb.AllowRequest(), "Request should be denied when forced Open")
+	cb.RecordSuccess()
+	assert.Equal(t, StateOpen, cb.State(), "State should still be Open")
+
+	// forced closed stays closed through failures
+	cb.Force(StateClosed)
+	cb.RecordFailure()
+	cb.RecordFailure()
+	assert.Equal(t, StateClosed, cb.State(), "State should still be Closed")
+	assert.True(t, cb.AllowRequest(), "Request should be allowed when forced Closed")
+
+	stats := cb.Stats()
+	assert.True(t, stats.Forced, "Breaker should be forced")
+	assert.Equal(t, uint32(2), stats.Failures, "Failures should match")
+	assert.Equal(t, uint64(1), stats.TotalSuccesses, "Successes should match")
+
+	// released breakers go back to counting
+	cb.Release()
+	cb.RecordFailure()
+	assert.Equal(t, StateOpen, cb.State(), "State should be Open after a failure")
+
+	stats = cb.Stats()
+	assert.False(t, stats.Forced, "Breaker should not be forced")
+	assert.Equal(t, uint64(3), stats.TotalFailures, "Failures should match")
+	assert.Equal(t, stats.LastStateChange, stats.History[len(stats.History)-1].Time, "Last change should match")
+
+	var states []CircuitBreakerState
+	for _, transition := range stats.History {
+		states = append(states, transition.To)
+	}
+	assert.Equal(t, []CircuitBreakerState{StateOpen, StateClosed, StateClosed, StateOpen}, states, "History should match")
+	assert.True(t, stats.History[0].Forced, "Transition should be forced")
+	assert.False(t, stats.History[3].Forced, "Transition should not be forced")
+
+	// the history is bounded
+	for range circuitBreakerHistory {
+		cb.Force(StateOpen)
+	}
+	assert.Len(t, cb.Stats().History, circuitBreakerHistory, "History should be bounded")
+
+	text, err := StateHalfOpen.MarshalText()
+	assert.NoError(t, err, "An error was not expected")
+	assert.Equal(t, "half-open", string(text), "State name should match")
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+
+	e "github.com/eirka/eirka-libs/errors"
+)
+
+// DatabaseCircuitBreaker trips when the controllers keep failing on MySQL, while
+// it is open cached pages are served from whatever the cache still holds
+var DatabaseCircuitBreaker = NewCircuitBreaker()
+
+// ErrDatabaseUnavailable is the response while the database circuit is open and
+// the cache has nothing to serve instead
+var ErrDatabaseUnavailable = &e.RequestError{ErrorString: "service unavailable", ErrorCode: http.StatusServiceUnavailable}
+
+// degradedHeader marks responses served from the cache while the database is down
+const degradedHeader = "X-Degraded"
+
+// errDatabaseOpen is returned by fills skipped because the database circuit is open
+var errDatabaseOpen = errors.New("database circuit is open")
+
+// DatabaseBreaker is a middleware that keeps requests from reaching the controllers
+// while the database circuit is open, and reports whether the controllers that did
+// run failed on the database. It goes after the cache middleware, which serves what
+// it can from the cache and guards its own fills.
+func DatabaseBreaker() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !DatabaseCircuitBreaker.AllowRequest() {
+			databaseUnavailable(c)
+			return
+		}
+
+		c.Next()
+
+		recordDatabase(c.Errors, nil)
+	}
+}
+
+// databaseUnavailable responds with a 503 telling the client when to try again
+func databaseUnavailable(c *gin.Context) {
+	retry := max(1, math.Ceil(DatabaseCircuitBreaker.RetryAfter().Seconds()))
+
+	c.Set("databaseUnavailable", true)
+	c.Header("Retry-After", strconv.Itoa(int(retry)))
+	c.JSON(e.ErrorMessage(ErrDatabaseUnavailable))
+	c.Error(errDatabaseOpen).SetMeta("Database.CircuitOpen")
+	c.Abort()
+}
+
+// markDegraded flags a response served from the cache because the database is down
+func markDegraded(c *gin.Context) {
+	c.Set("databaseDegraded", true)
+	c.Header(degradedHeader, "database")
+}
+
+// databaseDown reports whether the database circuit is not closed, cached entries
+// are then served as they are instead of waiting on a fill
+func databaseDown() bool {
+	return DatabaseCircuitBreaker.State() != StateClosed
+}
+
+// recordDatabase reports the outcome of a controller run to the database breaker.
+// Fill timeouts and errors from the SQL driver are failures, anything else means
+// the database answered.
+func recordDatabase(errs []*gin.Error, err error) {
+	if errors.Is(err, errFillTimeout) {
+		DatabaseCircuitBreaker.RecordFailure()
+		return
+	}
+
+	for _, ge := range errs {
+		if databaseError(ge.Err) {
+			DatabaseCircuitBreaker.RecordFailure()
+			return
+		}
+	}
+
+	DatabaseCircuitBreaker.RecordSuccess()
+}
+
+// databaseError reports whether an error came from MySQL or the connection to it
+func databaseError(err error) bool {
+	var mysqlErr *mysql.MySQLError
+
+	return errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn) ||
+		errors.As(err, &mysqlErr)
+}
@@ -0,0 +1,150 @@
+package middleware
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	e "github.com/eirka/eirka-libs/errors"
+	"github.com/gin-gonic/gin"
+	"github.com/go-sql-driver/mysql"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatabaseError(t *testing.T) {
+	assert.True(t, databaseError(driver.ErrBadConn), "Bad connections should count")
+	assert.True(t, databaseError(&mysql.MySQLError{Number: 1040, Message: "Too many connections"}), "MySQL errors should count")
+	assert.True(t, databaseError(fmt.Errorf("query: %w", context.DeadlineExceeded)), "Timeouts should count")
+	assert.False(t, databaseError(e.ErrNotFound), "Not found should not count")
+	assert.False(t, databaseError(e.ErrInvalidParam), "Bad requests should not count")
+}
+
+func TestDatabaseBreaker(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	DatabaseCircuitBreaker = NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    2,
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+	})
+	defer func() { DatabaseCircuitBreaker = NewCircuitBreaker() }()
+
+	var calls atomic.Int32
+
+	router := gin.New()
+	router.Use(DatabaseBreaker())
+
+	router.GET("/user/favorite/:id", func(c *gin.Context) {
+		calls.Add(1)
+
+		if c.Param("id") == "0" {
+			c.JSON(e.ErrorMessage(e.ErrNotFound))
+			c.Error(e.ErrNotFound)
+			return
+		}
+
+		c.JSON(e.ErrorMessage(e.ErrInternalError))
+		c.Error(driver.ErrBadConn)
+	})
+
+	// not found is an answer from the database
+	for range 3 {
+		performRequest(router, "GET", "/user/favorite/0")
+	}
+	assert.Equal(t, StateClosed, DatabaseCircuitBreaker.State(), "State should be Closed")
+
+	performRequest(router, "GET", "/user/favorite/1")
+	performRequest(router, "GET", "/user/favorite/1")
+	assert.Equal(t, StateOpen, DatabaseCircuitBreaker.State(), "State should be Open")
+
+	// the controller is no longer called
+	first := performRequest(router, "GET", "/user/favorite/1")
+	assert.Equal(t, 503, first.Code, "HTTP request code should match")
+	assert.Equal(t, "60", first.Header().Get("Retry-After"), "Retry-After should match")
+	assert.Equal(t, int32(5), calls.Load(), "Controller should not run")
+}
+
+func TestCacheDatabaseDegraded(t *testing.T) {
+	gin.SetMode(gin.ReleaseMode)
+
+	CircuitBreaker = NewCircuitBreaker()
+	InMemoryCache = NewMemoryCache()
+
+	Store = NewMemoryStore(DefaultMemoryStoreSize)
+	defer func() { Store = NewRedisStore() }()
+
+	DatabaseCircuitBreaker = NewCircuitBreakerWithConfig(CircuitBreakerConfig{
+		FailureThreshold:    1,
+		ResetTimeout:        time.Minute,
+		HalfOpenMaxRequests: 1,
+	})
+	defer func() { DatabaseCircuitBreaker = NewCircuitBreaker() }()
+
+	var calls atomic.Int32
+
+	config := DefaultCacheConfig
+	config.FreshFor = 10 * time.Millisecond
+	config.EarlyRefreshBeta = 0
+
+	router := gin.New()
+	router.Use(CacheWithConfig(config))
+	router.Use(DatabaseBreaker())
+
+	router.GET("/index/:ib/:page", func(c *gin.Context) {
+		calls.Add(1)
+		c.Data(200, "application/json", []byte(`{"index":"test"}`))
+	})
+
+	router.GET("/random/image/:ib", func(c *gin.Context) {
+		calls.Add(1)
+		c.Data(200, "application/json", []byte(`{"random":"test"}`))
+	})
+
+	fill := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, fill.Code, "HTTP request code should match")
+	assert.Empty(t, fill.Header().Get(degradedHeader), "Response should not be degraded")
+
+	// a negative entry from before the outage that has since expired
+	missing := newCacheEntry([]byte(`{"error_message":"request not found"}`))
+	missing.Status = 404
+	missing.Expires = time.Now().Add(-time.Second)
+	raw, err := encodeEntry(missing)
+	assert.NoError(t, err, "An error was not expected")
+	assert.NoError(t, Store.Set(CacheKey{Key: "index:1", Field: "3"}, raw, 0), "An error was not expected")
+
+	DatabaseCircuitBreaker.RecordFailure()
+	assert.Equal(t, StateOpen, DatabaseCircuitBreaker.State(), "State should be Open")
+
+	time.Sleep(20 * time.Millisecond)
+
+	// the stale entry is served as is and marked
+	stale := performRequest(router, "GET", "/index/1/1")
+	assert.Equal(t, 200, stale.Code, "HTTP request code should match")
+	assert.Equal(t, `{"index":"test"}`, stale.Body.String(), "Body should match")
+	assert.Equal(t, "database", stale.Header().Get(degradedHeader), "Response should be degraded")
+
+	// so is the expired entry
+	expired := performRequest(router, "GET", "/index/1/3")
+	assert.Equal(t, 404, expired.Code, "HTTP request code should match")
+	assert.Equal(t, "database", expired.Header().Get(degradedHeader), "Response should be degraded")
+
+	// without an entry the client is told to come back later
+	uncached := performRequest(router, "GET", "/index/1/2")
+	assert.Equal(t, 503, uncached.Code, "HTTP request code should match")
+	assert.NotEmpty(t, uncached.Header().Get("Retry-After"), "Retry-After should be set")
+
+	// routes that are never cached are stopped before the controller
+	random := performRequest(router, "GET", "/random/image/1")
+	assert.Equal(t, 503, random.Code, "HTTP request code should match")
+
+	// wait for the refresh of the stale entry to give up
+	assert.Eventually(t, func() bool {
+		_, running := refreshing.Load("index:1:1")
+		return !running
+	}, time.Second, time.Millisecond, "Refresh should finish")
+
+	assert.Equal(t, int32(1), calls.Load(), "Controller should only run for the first fill")
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// memoryItemOverhead is a rough per item cost of the list element, map entry and metadata
+const memoryItemOverhead = 128
+
+// MemoryCacheConfig holds the configuration for the in-process cache
+type MemoryCacheConfig struct {
+	// MaxSize is the total number of bytes the cache may hold, zero disables the cache
+	MaxSize int64
+	// MaxItemSize is the largest single response that will be kept in memory, zero means no limit
+	MaxItemSize int64
+	// TTL is how long an item is kept for routes without their own TTL
+	TTL time.Duration
+	// RouteTTL holds the TTL per route, keyed by the first path segment
+	RouteTTL map[string]time.Duration
+}
+
+// DefaultMemoryCacheConfig provides sensible defaults for the in-process cache.
+// TTLs are kept short since invalidations from the other services only reach Redis.
+var DefaultMemoryCacheConfig = MemoryCacheConfig{
+	MaxSize:     64 << 20,
+	MaxItemSize: 1 << 20,
+	TTL:         5 * time.Second,
+	RouteTTL: map[string]time.Duration{
+		"index":       2 * time.Second,
+		"thread":      2 * time.Second,
+		"image":       10 * time.Second,
+		"tags":        10 * time.Second,
+		"popular":     30 * time.Second,
+		"favorited":   30 * time.Second,
+		"tagtypes":    60 * time.Second,
+		"imageboards": 60 * time.Second,
+	},
+}
+
+// MemoryCache is a bounded, size aware LRU that sits in front of Redis
+type MemoryCache struct {
+	mutex  sync.Mutex
+	config MemoryCacheConfig
+	size   int64
+	items  map[string]*list.Element
+	order  *list.List
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+// memoryItem is a single entry in the memory cache
+type memoryItem struct {
+	key     string
+	entry   *cacheEntry
+	size    int64
+	expires time.Time
+}
+
+// NewMemoryCache creates a new memory cache with default configuration
+func NewMemoryCache() *MemoryCache {
+	return NewMemoryCacheWithConfig(DefaultMemoryCacheConfig)
+}
+
+// NewMemoryCacheWithConfig creates a new memory cache with the given configuration
+func NewMemoryCacheWithConfig(config MemoryCacheConfig) *MemoryCache {
+	return &MemoryCache{
+		config: config,
+		items:  make(map[string]*list.Element),
+		order:  list.New(),
+	}
+}
+
+// Get returns the entry for a key if it is present and has not expired
+func (mc *MemoryCache) Get(key string) (*cacheEntry, bool) {
+	if mc.config.MaxSize <= 0 {
+		return nil, false
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	element, ok := mc.items[key]
+	if !ok {
+		mc.misses.Add(1)
+		return nil, false
+	}
+
+	item := element.Value.(*memoryItem)
+
+	// Drop expired items so the space is reclaimed straight away
+	if time.Now().After(item.expires) {
+		mc.remove(element)
+		mc.misses.Add(1)
+		return nil, false
+	}
+
+	mc.order.MoveToFront(element)
+	mc.hits.Add(1)
+
+	return item.entry, true
+}
+
+// Set stores an entry for a key using the TTL of the given route
+func (mc *MemoryCache) Set(route, key string, entry *cacheEntry) {
+	size := int64(len(key)+entry.size()) + memoryItemOverhead
+
+	if mc.config.MaxSize <= 0 || size > mc.config.MaxSize {
+		return
+	}
+
+	if mc.config.MaxItemSize > 0 && size > mc.config.MaxItemSize {
+		return
+	}
+
+	ttl, ok := mc.config.RouteTTL[route]
+	if !ok {
+		ttl = mc.config.TTL
+	}
+
+	expires := time.Now().Add(ttl)
+
+	// Negative entries never outlive their own expiry
+	if !entry.Expires.IsZero() && entry.Expires.Before(expires) {
+		expires = entry.Expires
+	}
+
+	item := &memoryItem{
+		key:     key,
+		entry:   entry,
+		size:    size,
+		expires: expires,
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if element, ok := mc.items[key]; ok {
+		mc.remove(element)
+	}
+
+	mc.items[key] = mc.order.PushFront(item)
+	mc.size += size
+
+	// Evict the least recently used items until we are back under the cap
+	for mc.size > mc.config.MaxSize {
+		mc.remove(mc.order.Back())
+	}
+}
+
+// Stats returns the total hits and misses since the cache was created
+func (mc *MemoryCache) Stats() (hits, misses uint64) {
+	return mc.hits.Load(), mc.misses.Load()
+}
+
+// Size returns the number of bytes held by the cache
+func (mc *MemoryCache) Size() int64 {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	return mc.size
+}
+
+// remove deletes an element, the caller must hold the mutex
+func (mc *MemoryCache) remove(element *list.Element) {
+	item := element.Value.(*memoryItem)
+
+	mc.order.Remove(element)
+	delete(mc.items, item.key)
+	mc.size -= item.size
+}
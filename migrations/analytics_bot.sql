@@ -0,0 +1,5 @@
+-- Flags requests from crawlers and scrapers (user-021). Apply before deploying the
+-- eirka-get version that writes request_bot, existing rows count as people.
+ALTER TABLE analytics
+  ADD COLUMN request_bot tinyint(1) NOT NULL DEFAULT 0,
+  ADD KEY idx_analytics_popular (ib_id, request_itemkey, request_bot, request_time);
@@ -0,0 +1,19 @@
+-- Daily hit counts the retention command rolls old analytics rows up into (user-020).
+-- Apply before running eirka-get -retention with RetentionAggregate. The primary key is
+-- what ON DUPLICATE KEY UPDATE adds repeated batches for the same day and item onto.
+CREATE TABLE IF NOT EXISTS analytics_daily (
+  ib_id int unsigned NOT NULL,
+  request_day date NOT NULL,
+  request_itemkey varchar(20) NOT NULL,
+  request_itemvalue varchar(64) NOT NULL,
+  request_hits int unsigned NOT NULL DEFAULT 0,
+  request_bots int unsigned NOT NULL DEFAULT 0,
+  request_cached int unsigned NOT NULL DEFAULT 0,
+  request_latency bigint unsigned NOT NULL DEFAULT 0,
+  PRIMARY KEY (ib_id, request_day, request_itemkey, request_itemvalue),
+  KEY idx_analytics_daily_day (request_day)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4;
+
+-- Retention walks the table oldest first, skip this if request_time is already indexed.
+ALTER TABLE analytics
+  ADD KEY idx_analytics_time (request_time);
@@ -0,0 +1,5 @@
+-- Marks searches that found nothing (user-022). Apply before deploying the eirka-get
+-- version that writes request_empty. Search terms are recorded in request_itemvalue cut
+-- to 64 characters, widen it first if it is narrower.
+ALTER TABLE analytics
+  ADD COLUMN request_empty tinyint(1) NOT NULL DEFAULT 0;
@@ -0,0 +1,7 @@
+-- Referring host, browser family and device class (user-023). Apply before deploying
+-- the eirka-get version that writes them. The referrer holds a host of up to 255
+-- characters (referrerMaxLength), the browser and device are short fixed names.
+ALTER TABLE analytics
+  ADD COLUMN request_referrer varchar(255) NOT NULL DEFAULT '',
+  ADD COLUMN request_browser varchar(16) NOT NULL DEFAULT '',
+  ADD COLUMN request_device varchar(16) NOT NULL DEFAULT '';
@@ -32,7 +32,7 @@ func (i *PopularModel) Get() (err error) {
 		return
 	}
 
-	// SQL query to select the most popular images based on the number of hits in the last 3 days.
+	// SQL query to select the most popular images based on the number of hits from people in the last 3 days.
 	// It joins the analytics, images, posts, and threads tables to gather the necessary data.
 	// The results are filtered to exclude deleted threads and posts, and are limited to the top 50 hits.
 	rows, err := dbase.Query(`
@@ -46,6 +46,7 @@ func (i *PopularModel) Get() (err error) {
 			WHERE analytics.ib_id = ? 
 			AND request_itemkey = "image" 
 			AND request_time >= (NOW() - INTERVAL 3 DAY)
+			AND request_bot = 0
 			AND thread_deleted != 1 
 			AND post_deleted != 1
 			GROUP BY request_itemvalue
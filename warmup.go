@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/eirka/eirka-libs/user"
+	"github.com/eirka/eirka-libs/validate"
+
+	m "github.com/eirka/eirka-get/middleware"
+	"github.com/eirka/eirka-get/models"
+)
+
+// warmupRoutes are the board routes filled by the warmup, paged routes are walked
+// from the first page until they run out of pages or reach the page limit
+var warmupRoutes = []struct {
+	route string
+	paged bool
+}{
+	{"index", true},
+	{"directory", true},
+	{"tags", true},
+	{"popular", false},
+	{"new", false},
+	{"favorited", false},
+}
+
+// warmupWorkers bounds how many pages are built at once so the warmup does not
+// become the thundering herd it is meant to prevent
+const warmupWorkers = 4
+
+// warmupEngine returns a router with the cached public pages behind the cache
+// middleware only, so warmup requests are not recorded by the analytics
+func warmupEngine() *gin.Engine {
+	r := gin.New()
+
+	r.Use(validate.ValidateParams())
+
+	public := r.Group("/")
+	public.Use(user.Auth(false))
+	public.Use(m.CacheWithConfig(cacheConfig))
+	public.Use(m.DatabaseBreaker())
+
+	publicRoutes(public)
+
+	return r
+}
+
+// warmCache fills the cache for the first pages of every board. The pages are
+// requested through the cache middleware so they are stored under the same keys
+// and in the same format as real requests, and pages that are already cached are
+// left alone. It returns the number of pages that were served successfully.
+func warmCache(handler http.Handler, pages uint) (int, error) {
+	boards := models.ImageboardsModel{}
+
+	err := boards.Get()
+	if err != nil {
+		return 0, err
+	}
+
+	var warmed atomic.Int64
+
+	// warm requests a page and reports whether it exists
+	warm := func(path string) bool {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if w.Code != http.StatusOK {
+			return false
+		}
+
+		warmed.Add(1)
+
+		return true
+	}
+
+	var g errgroup.Group
+	g.SetLimit(warmupWorkers)
+
+	g.Go(func() error {
+		warm("/imageboards")
+		warm("/tagtypes")
+		return nil
+	})
+
+	for _, board := range boards.Result.Body {
+		for _, route := range warmupRoutes {
+			g.Go(func() error {
+				if !route.paged {
+					warm(fmt.Sprintf("/%s/%d", route.route, board.ID))
+					return nil
+				}
+
+				for page := uint(1); page <= pages; page++ {
+					if !warm(fmt.Sprintf("/%s/%d/%d", route.route, board.ID, page)) {
+						break
+					}
+				}
+
+				return nil
+			})
+		}
+	}
+
+	err = g.Wait()
+
+	return int(warmed.Load()), err
+}